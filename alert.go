@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// AlertRule is checked after every stat is saved. There are two types:
+//
+//	threshold: the metric of any table or index is above Value in an interval.
+//	share: any region holds more than Ratio of the metric of the cluster.
+type AlertRule struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Tag  string `json:"tag"`
+	// Scope of the threshold rule, "table", "index" or both if empty.
+	Scope string  `json:"scope,omitempty"`
+	Value uint64  `json:"value,omitempty"`
+	Ratio float64 `json:"ratio,omitempty"`
+	// For is the number of consecutive intervals to break the rule before
+	// firing, 1 if not set.
+	For int `json:"for,omitempty"`
+
+	metric *metric
+}
+
+type alertConfig struct {
+	Webhooks []string     `json:"webhooks"`
+	Rules    []*AlertRule `json:"rules"`
+}
+
+// Alert is posted to the webhooks when it starts firing or is resolved.
+type Alert struct {
+	// Status is "firing" or "resolved".
+	Status   string    `json:"status"`
+	Rule     string    `json:"rule"`
+	Target   string    `json:"target"`
+	StartKey string    `json:"start_key"`
+	EndKey   string    `json:"end_key"`
+	Value    uint64    `json:"value"`
+	Share    float64   `json:"share,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+type alertState struct {
+	count  int
+	firing bool
+	alert  Alert
+}
+
+// Alerter checks the rules and notifies the webhooks.
+type Alerter struct {
+	sync.Mutex
+
+	rules    []*AlertRule
+	webhooks []string
+	// rule name and target -> state
+	states map[string]*alertState
+	// pending are the alerts in order waiting for the worker to notify,
+	// and wake wakes the worker up when there are any.
+	pending []Alert
+	wake    chan struct{}
+}
+
+// maxPendingAlerts is the number of alerts waiting for the slow webhooks,
+// the later firing ones are dropped if it is reached. The resolved ones are
+// always kept, or the webhooks would see them firing forever.
+const maxPendingAlerts = 1024
+
+// loadAlerter loads the rules and the webhooks from the JSON file.
+func loadAlerter(path string) (*Alerter, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg alertConfig
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	return newAlerter(cfg.Rules, cfg.Webhooks)
+}
+
+func newAlerter(rules []*AlertRule, webhooks []string) (*Alerter, error) {
+	for _, rule := range rules {
+		m, err := parseMetric(rule.Tag)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+		rule.metric = m
+
+		switch rule.Type {
+		case "threshold":
+			if rule.Scope != "" && rule.Scope != "table" && rule.Scope != "index" {
+				return nil, fmt.Errorf("rule %s: unknown scope %q", rule.Name, rule.Scope)
+			}
+		case "share":
+			if _, ok := derivedMetrics[rule.Tag]; ok {
+				return nil, fmt.Errorf("rule %s: share of %s is meaningless", rule.Name, rule.Tag)
+			}
+			if rule.Ratio <= 0 || rule.Ratio >= 1 {
+				return nil, fmt.Errorf("rule %s: ratio must be in (0, 1)", rule.Name)
+			}
+		default:
+			return nil, fmt.Errorf("rule %s: unknown type %q", rule.Name, rule.Type)
+		}
+		if rule.For <= 0 {
+			rule.For = 1
+		}
+	}
+
+	return &Alerter{
+		rules:    rules,
+		webhooks: webhooks,
+		states:   make(map[string]*alertState),
+		wake:     make(chan struct{}, 1),
+	}, nil
+}
+
+// breaches returns the alerts of the targets breaking the rule in the stat.
+func (rule *AlertRule) breaches(s *Stat, tbls []*Table) []Alert {
+	var alerts []Alert
+	switch rule.Type {
+	case "threshold":
+		var spans []keySpan
+		for _, span := range tableSpans(tbls) {
+			if !filters.match(span.table) {
+				continue
+			}
+			if rule.Scope == "table" && span.index != "" || rule.Scope == "index" && span.index == "" {
+				continue
+			}
+			spans = append(spans, span)
+		}
+
+		for i, v := range spanValues(spans, s.Regions, rule.metric) {
+			if v > rule.Value {
+				alerts = append(alerts, Alert{
+					Target:   spans[i].label,
+					StartKey: spans[i].start,
+					EndKey:   spans[i].end,
+					Value:    v,
+				})
+			}
+		}
+	case "share":
+		values := make([]uint64, len(s.Regions))
+		var total uint64
+		buf := make([]uint64, len(rule.metric.counters))
+		for i, r := range s.Regions {
+			for k, name := range rule.metric.counters {
+				buf[k] = counters[name](r)
+			}
+			values[i] = rule.metric.derive(buf)
+			total += values[i]
+		}
+		if total == 0 {
+			return nil
+		}
+
+		for i, v := range values {
+			share := float64(v) / float64(total)
+			if share > rule.Ratio {
+				r := s.Regions[i]
+				alerts = append(alerts, Alert{
+					Target:   r.String(),
+					StartKey: r.StartKey,
+					EndKey:   r.EndKey,
+					Value:    v,
+					Share:    share,
+				})
+			}
+		}
+	}
+
+	for i := range alerts {
+		alerts[i].Rule = rule.Name
+		alerts[i].Time = s.Time
+	}
+	return alerts
+}
+
+// check checks the rules with the new stat, and returns the alerts starting
+// firing or resolved. The gaps are skipped.
+func (a *Alerter) check(s *Stat, tbls []*Table) []Alert {
+	if s.Gap {
+		return nil
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	var alerts []Alert
+	breached := make(map[string]struct{})
+	for _, rule := range a.rules {
+		for _, alert := range rule.breaches(s, tbls) {
+			key := rule.Name + "/" + alert.Target
+			breached[key] = struct{}{}
+
+			st, ok := a.states[key]
+			if !ok {
+				st = &alertState{}
+				a.states[key] = st
+			}
+			st.count++
+			st.alert = alert
+			if !st.firing && st.count >= rule.For {
+				st.firing = true
+				alert.Status = "firing"
+				alerts = append(alerts, alert)
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(a.states))
+	for key := range a.states {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok := breached[key]; ok {
+			continue
+		}
+		st := a.states[key]
+		if st.firing {
+			alert := st.alert
+			alert.Status = "resolved"
+			alert.Time = s.Time
+			alerts = append(alerts, alert)
+		}
+		delete(a.states, key)
+	}
+
+	return alerts
+}
+
+// enqueue queues the alerts to notify without blocking the caller.
+func (a *Alerter) enqueue(alerts []Alert) {
+	if len(alerts) == 0 {
+		return
+	}
+
+	a.Lock()
+	dropped := 0
+	for _, alert := range alerts {
+		if len(a.pending) >= maxPendingAlerts && alert.Status != "resolved" {
+			dropped++
+			continue
+		}
+		a.pending = append(a.pending, alert)
+	}
+	a.Unlock()
+	if dropped > 0 {
+		log.Printf("too many pending alerts, drop %d firing alerts", dropped)
+	}
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run notifies the pending alerts in a batch whenever it is woken up, so
+// the webhooks receive them in the order they are checked.
+func (a *Alerter) run() {
+	for range a.wake {
+		a.Lock()
+		alerts := a.pending
+		a.pending = nil
+		a.Unlock()
+		a.notify(alerts)
+	}
+}
+
+// notify posts the alerts to all the webhooks as {"alerts": [...]}.
+func (a *Alerter) notify(alerts []Alert) {
+	if len(alerts) == 0 {
+		return
+	}
+
+	data, _ := json.Marshal(struct {
+		Alerts []Alert `json:"alerts"`
+	}{alerts})
+	for _, hook := range a.webhooks {
+		resp, err := httpClient.Post(hook, "application/json", bytes.NewReader(data))
+		if err != nil {
+			log.Printf("notify %s failed: %v", hook, err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			log.Printf("notify %s failed: %s", hook, resp.Status)
+		}
+	}
+}
+
+var alerter *Alerter
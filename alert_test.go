@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAlerter(t *testing.T) {
+	received := make(chan []Alert, 10)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Alerts []Alert `json:"alerts"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		received <- body.Alerts
+	}))
+	defer s.Close()
+
+	dir, err := ioutil.TempDir("", "keyvisual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := `{
+		"webhooks": ["` + s.URL + `"],
+		"rules": [
+			{"name": "hot-index", "type": "threshold", "scope": "index", "tag": "written_bytes", "value": 50, "for": 2},
+			{"name": "write-skew", "type": "share", "tag": "written_bytes", "ratio": 0.5}
+		]
+	}`
+	path := filepath.Join(dir, "rules.json")
+	if err = ioutil.WriteFile(path, []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := loadAlerter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tbls := []*Table{{ID: 1, DB: "test", Name: "t", Indices: map[int64]string{1: "idx"}}}
+	newStat := func(index uint64, record uint64) *Stat {
+		return &Stat{
+			Time: time.Now(),
+			Regions: []*regionInfo{
+				newRegionInfo("", GenTableIndexPrefix(1, 1), 0),
+				newRegionInfo(GenTableIndexPrefix(1, 1), GenTableRecordPrefix(1), index),
+				newRegionInfo(GenTableRecordPrefix(1), "", record),
+			},
+		}
+	}
+
+	type event struct {
+		status string
+		rule   string
+		target string
+	}
+	check := func(s *Stat, expected ...event) {
+		alerts := a.check(s, tbls)
+		if len(alerts) != len(expected) {
+			t.Fatalf("want %v, but got %v", expected, alerts)
+		}
+		for i, e := range expected {
+			if alerts[i].Status != e.status || alerts[i].Rule != e.rule || alerts[i].Target != e.target {
+				t.Fatalf("want %v, but got %v", e, alerts[i])
+			}
+		}
+	}
+
+	index := GenTableIndexPrefix(1, 1)
+	region := "[" + index + ", " + GenTableRecordPrefix(1) + ")"
+	check(newStat(100, 10), event{"firing", "write-skew", region})
+	check(newStat(100, 10), event{"firing", "hot-index", "test.t.idx"})
+	check(newStat(100, 10))
+	check(&Stat{Gap: true})
+	check(newStat(10, 10), event{"resolved", "hot-index", "test.t.idx"}, event{"resolved", "write-skew", region})
+	check(newStat(10, 100), event{"firing", "write-skew", "[" + GenTableRecordPrefix(1) + ", )"})
+
+	// the resolved alerts are kept even if there are too many pending ones
+	for i := 0; i <= maxPendingAlerts; i++ {
+		a.enqueue([]Alert{{Status: "firing", Rule: "hot-index", Target: "test.t.idx"}})
+	}
+	a.enqueue([]Alert{{Status: "resolved", Rule: "hot-index", Target: "test.t.idx"}})
+	if len(a.pending) != maxPendingAlerts+1 || a.pending[maxPendingAlerts].Status != "resolved" {
+		t.Fatalf("unexpected %d pending alerts", len(a.pending))
+	}
+	a.pending = nil
+
+	// the alerts are notified in the order they are queued
+	go a.run()
+	defer close(a.wake)
+	a.enqueue([]Alert{{Status: "firing", Rule: "hot-index", Target: "test.t.idx"}})
+	a.enqueue([]Alert{{Status: "resolved", Rule: "hot-index", Target: "test.t.idx"}})
+	var statuses []string
+	for len(statuses) < 2 {
+		select {
+		case alerts := <-received:
+			for _, alert := range alerts {
+				statuses = append(statuses, alert.Status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no alert received")
+		}
+	}
+	if !reflect.DeepEqual(statuses, []string{"firing", "resolved"}) {
+		t.Fatalf("unexpected alerts %v", statuses)
+	}
+
+	for _, rule := range []*AlertRule{
+		{Name: "a", Type: "unknown", Tag: "written_bytes"},
+		{Name: "b", Type: "threshold", Tag: "foo"},
+		{Name: "c", Type: "threshold", Tag: "written_bytes", Scope: "db"},
+		{Name: "d", Type: "share", Tag: "written_bytes", Ratio: 2},
+		{Name: "e", Type: "share", Tag: "bytes_per_key", Ratio: 0.5},
+	} {
+		if _, err = newAlerter([]*AlertRule{rule}, nil); err == nil {
+			t.Fatalf("expect error for rule %s", rule.Name)
+		}
+	}
+}
@@ -0,0 +1,564 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type outStat struct {
+	StartTime time.Time `json:"start"`
+	EndTime   time.Time `json:"end"`
+	Unit      string    `json:"unit"`
+	// Times is the start time of every column, and Gaps is the indices of
+	// the columns without any stat.
+	Times []time.Time `json:"times"`
+	Gaps  []int       `json:"gaps,omitempty"`
+
+	Heatmaps []Heatmap `json:"heatmaps"`
+}
+
+// heatmapRequest is the query shared by the heatmap APIs, like
+// start=-10m&end=-1m&tag=written_bytes,read_bytes&N=128&squash=variance&max_columns=60&agg=max
+type heatmapRequest struct {
+	startTime time.Time
+	endTime   time.Time
+	// loc is the time zone of the output times
+	loc     *time.Location
+	metrics []*metric
+	buckets int
+	squash  squashFunc
+
+	// maxColumns and step merge the adjacent columns by agg
+	maxColumns int
+	step       time.Duration
+	agg        aggFunc
+}
+
+// parseTime parses the time relative to now like -10m, in RFC3339 like
+// 2026-01-01T10:00:00+08:00 or without the zone in loc, or the unix
+// timestamp in seconds or milliseconds.
+func parseTime(v string, now time.Time, loc *time.Location) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(d), nil
+	}
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		// seconds until year 33658
+		if n >= 1e12 || n <= -1e12 {
+			return time.Unix(0, n*int64(time.Millisecond)), nil
+		}
+		return time.Unix(n, 0), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02T15:04:05", v, loc); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a duration like -10m, an RFC3339 time or a unix timestamp", v)
+}
+
+// parseLocation parses the time zone name like Asia/Shanghai, or the offset
+// like +08:00.
+func parseLocation(v string) (*time.Location, error) {
+	if loc, err := time.LoadLocation(v); err == nil {
+		return loc, nil
+	}
+	if t, err := time.Parse("-07:00", v); err == nil {
+		_, offset := t.Zone()
+		return time.FixedZone(v, offset), nil
+	}
+	return nil, fmt.Errorf("unknown time zone %q", v)
+}
+
+func parseHeatmapRequest(r *http.Request) (*heatmapRequest, error) {
+	req := &heatmapRequest{buckets: *bucketNum}
+
+	req.loc = time.Local
+	if v := r.FormValue("tz"); v != "" {
+		loc, err := parseLocation(v)
+		if err != nil {
+			return nil, err
+		}
+		req.loc = loc
+	}
+
+	now := time.Now()
+	req.endTime = now
+	req.startTime = now.Add(-*interval)
+	if v := r.FormValue("start"); v != "" {
+		t, err := parseTime(v, now, req.loc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start: %v", err)
+		}
+		req.startTime = t
+	}
+	if v := r.FormValue("end"); v != "" {
+		t, err := parseTime(v, now, req.loc)
+		if err != nil {
+			return nil, fmt.Errorf("invalid end: %v", err)
+		}
+		req.endTime = t
+	}
+	if req.startTime.After(req.endTime) {
+		return nil, fmt.Errorf("start %s is after end %s", req.startTime.Format(time.RFC3339), req.endTime.Format(time.RFC3339))
+	}
+
+	tag := r.FormValue("tag")
+	if tag == "" {
+		tag = "written_bytes"
+	}
+	metrics, err := parseMetrics(tag)
+	if err != nil {
+		return nil, err
+	}
+	req.metrics = metrics
+
+	if v := r.FormValue("N"); v != "" {
+		if req.buckets, err = strconv.Atoi(v); err != nil || req.buckets <= 0 {
+			return nil, fmt.Errorf("invalid N %q", v)
+		}
+	}
+
+	mode := r.FormValue("squash")
+	if mode == "" {
+		mode = *squash
+	}
+	var ok bool
+	if req.squash, ok = squashFuncs[mode]; !ok {
+		return nil, fmt.Errorf("unknown squash mode %q", mode)
+	}
+
+	agg := r.FormValue("agg")
+	if agg == "" {
+		agg = "sum"
+	}
+	if req.agg, ok = aggFuncs[agg]; !ok {
+		return nil, fmt.Errorf("unknown aggregation %q", agg)
+	}
+	if v := r.FormValue("max_columns"); v != "" {
+		if req.maxColumns, err = strconv.Atoi(v); err != nil || req.maxColumns <= 0 {
+			return nil, fmt.Errorf("invalid max_columns %q", v)
+		}
+	}
+	if v := r.FormValue("step"); v != "" {
+		if req.step, err = time.ParseDuration(v); err != nil || req.step <= 0 {
+			return nil, fmt.Errorf("invalid step %q", v)
+		}
+	}
+
+	return req, nil
+}
+
+// statColumns are the regions of every column in the heatmaps.
+type statColumns struct {
+	regions [][]*regionInfo
+	times   []time.Time
+	isGap   []bool
+	unit    time.Duration
+}
+
+// loadColumns loads the stats in the requested time range, returns nil if
+// there is no stat yet.
+func (req *heatmapRequest) loadColumns() (*statColumns, error) {
+	stats, err := stat.rangeStats(req.startTime, req.endTime)
+	if err != nil || len(stats) == 0 {
+		return nil, err
+	}
+	stats = fillGaps(stats, req.startTime, req.endTime, *interval)
+
+	cols := &statColumns{
+		regions: make([][]*regionInfo, len(stats)),
+		times:   make([]time.Time, len(stats)),
+		isGap:   make([]bool, len(stats)),
+		unit:    *interval,
+	}
+	for i, s := range stats {
+		cols.regions[i] = s.Regions
+		cols.times[i] = s.Time
+		cols.isGap[i] = s.Gap
+	}
+	if stats[0].Interval != 0 {
+		cols.unit = stats[0].Interval
+	}
+	return cols, nil
+}
+
+// output merges the adjacent columns of the heatmaps as requested.
+func (req *heatmapRequest) output(cols *statColumns, heatmaps []Heatmap) outStat {
+	times, isGap, unit := cols.times, cols.isGap, cols.unit
+
+	n := 1
+	if req.step > unit {
+		n = int(req.step / unit)
+	}
+	if req.maxColumns > 0 && (len(times)+n-1)/n > req.maxColumns {
+		n = (len(times) + req.maxColumns - 1) / req.maxColumns
+	}
+	if n > 1 {
+		for i := range heatmaps {
+			heatmaps[i].compressColumns(isGap, n, req.agg, req.metrics)
+		}
+		times, isGap = compressTimes(times, isGap, n)
+		unit *= time.Duration(n)
+	}
+
+	var gaps []int
+	for i, gap := range isGap {
+		if gap {
+			gaps = append(gaps, i)
+		}
+	}
+	times = inLocation(times, req.loc)
+
+	return outStat{
+		StartTime: cols.times[0].In(req.loc),
+		EndTime:   cols.times[len(cols.times)-1].In(req.loc),
+		Unit:      unit.String(),
+		Times:     times,
+		Gaps:      gaps,
+		Heatmaps:  heatmaps,
+	}
+}
+
+// inLocation returns the times in loc.
+func inLocation(times []time.Time, loc *time.Location) []time.Time {
+	newTimes := make([]time.Time, len(times))
+	for i, t := range times {
+		newTimes[i] = t.In(loc)
+	}
+	return newTimes
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	data, _ := json.Marshal(v)
+	w.Write(data)
+}
+
+// heatmapScope selects the heatmaps to build of the columns.
+type heatmapScope struct {
+	// cluster builds one heatmap of the whole key space
+	cluster bool
+	// rollup sums up the partitions of a table into one heatmap
+	rollup bool
+	// dbs and names only build the heatmaps of the matched tables
+	dbs   []*regexp.Regexp
+	names []*regexp.Regexp
+}
+
+// parseHeatmapScope parses the query like
+// scope=table&partitions=rollup&db=test,tmp_*&table=/^t/
+func parseHeatmapScope(r *http.Request) (*heatmapScope, error) {
+	sc := &heatmapScope{}
+	switch scope := r.FormValue("scope"); scope {
+	case "", "table":
+	case "cluster":
+		sc.cluster = true
+	default:
+		return nil, fmt.Errorf("unknown scope %q", scope)
+	}
+	switch partitions := r.FormValue("partitions"); partitions {
+	case "", "split":
+	case "rollup":
+		sc.rollup = true
+	default:
+		return nil, fmt.Errorf("unknown partitions mode %q", partitions)
+	}
+
+	var err error
+	if sc.dbs, err = parsePatterns(r.FormValue("db")); err != nil {
+		return nil, err
+	}
+	if sc.names, err = parsePatterns(r.FormValue("table")); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// each builds the heatmaps of the columns one table at a time, and calls f
+// with them until f returns an error.
+func (sc *heatmapScope) each(req *heatmapRequest, cols *statColumns, f func(heatmaps []Heatmap) error) error {
+	startTime, endTime := cols.times[0], cols.times[len(cols.times)-1]
+	tbls := loadTablesAt(startTime, endTime)
+	if sc.cluster {
+		return f([]Heatmap{clusterHeatmap(tbls, cols.regions, startTime, endTime, req.buckets, req.squash, req.metrics)})
+	}
+
+	for _, tbl := range filters.filter(tbls) {
+		if len(sc.dbs) > 0 && !matchAny(sc.dbs, tbl.DB) || len(sc.names) > 0 && !matchAny(sc.names, tbl.Name) {
+			continue
+		}
+		if err := f(tableHeatmap(nil, tbl, cols.regions, startTime, endTime, req.buckets, req.squash, req.metrics, sc.rollup)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// build builds all the heatmaps of the columns.
+func (sc *heatmapScope) build(req *heatmapRequest, cols *statColumns) []Heatmap {
+	var heatmaps []Heatmap
+	sc.each(req, cols, func(hs []Heatmap) error {
+		heatmaps = append(heatmaps, hs...)
+		return nil
+	})
+	if heatmaps == nil {
+		heatmaps = []Heatmap{}
+	}
+	return heatmaps
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	req, err := parseHeatmapRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sc, err := parseHeatmapScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// format=csv or ndjson streams the rows of every bucket and column, and
+	// viz is the network JSON of clustergrammer for the frontend
+	format := r.FormValue("format")
+	if format != "" && format != "json" && format != "csv" && format != "ndjson" && format != "viz" {
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	cols, err := req.loadColumns()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch format {
+	case "csv", "ndjson":
+		if err = writeRows(r.Context(), w, format, req, sc, cols); err != nil {
+			log.Printf("export the heatmaps failed: %v", err)
+		}
+	case "viz":
+		out := outStat{}
+		if cols != nil {
+			out = req.output(cols, sc.build(req, cols))
+		}
+		writeJSON(w, buildViz(out))
+	default:
+		if cols == nil {
+			return
+		}
+		writeJSON(w, req.output(cols, sc.build(req, cols)))
+	}
+}
+
+// parseKeyRange parses the key range to drill down, either the hex encoded
+// start_key and end_key, or the table with an optional index, or the table
+// with the start_handle and end_handle of the records. The table is the ID
+// of a partition, or of a partitioned table with the partition name. It
+// returns the labels of the range too, by the table live in
+// [startTime, endTime].
+func parseKeyRange(r *http.Request, startTime time.Time, endTime time.Time) (string, string, []string, error) {
+	table := r.FormValue("table")
+	if table == "" {
+		start := strings.ToUpper(r.FormValue("start_key"))
+		end := strings.ToUpper(r.FormValue("end_key"))
+		for _, key := range []string{start, end} {
+			if _, err := hex.DecodeString(key); err != nil {
+				return "", "", nil, fmt.Errorf("invalid key %q: %v", key, err)
+			}
+		}
+		if end != "" && start >= end {
+			return "", "", nil, errors.New("start_key must be less than end_key")
+		}
+		return start, end, nil, nil
+	}
+
+	tableID, err := strconv.ParseInt(table, 10, 64)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("invalid table %q", table)
+	}
+	labels := []string{"", table, ""}
+	t, found := tables.at(tableID, startTime, endTime)
+	if found {
+		labels = []string{t.DB, t.Name, ""}
+	}
+	if found && len(t.Partitions) > 0 {
+		// the keys of a partitioned table are under the IDs of its partitions
+		name := r.FormValue("partition")
+		var names []string
+		var part *Partition
+		for i, p := range t.Partitions {
+			names = append(names, p.Name)
+			if p.ID == tableID || tableID == t.ID && strings.EqualFold(p.Name, name) {
+				part = &t.Partitions[i]
+			}
+		}
+		if part == nil {
+			return "", "", nil, fmt.Errorf("table %s is partitioned, partition must be one of %s", t, strings.Join(names, ", "))
+		}
+		tableID = part.ID
+		labels[1] = t.partitionName(*part)
+	}
+
+	if index := r.FormValue("index"); index != "" {
+		indexID, err := strconv.ParseInt(index, 10, 64)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid index %q", index)
+		}
+		labels[2] = index
+		if found {
+			if name, ok := t.Indices[indexID]; ok {
+				labels[2] = name
+			}
+		}
+		return GenTableIndexPrefix(tableID, indexID), GenTableIndexPrefix(tableID, indexID+1), labels, nil
+	}
+
+	start := GenTableRecordPrefix(tableID)
+	end := GenTablePrefix(tableID + 1)
+	if v := r.FormValue("start_handle"); v != "" {
+		handle, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid start_handle %q", v)
+		}
+		start = GenTableRecordKey(tableID, handle)
+	}
+	if v := r.FormValue("end_handle"); v != "" {
+		handle, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("invalid end_handle %q", v)
+		}
+		end = GenTableRecordKey(tableID, handle)
+	}
+	if start >= end {
+		return "", "", nil, errors.New("start_handle must be less than end_handle")
+	}
+	return start, end, labels, nil
+}
+
+// rangeHandler builds the heatmap of only the regions in a key range with
+// its own bucket number, to drill down into a bucket.
+func rangeHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := parseHeatmapRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	start, end, labels, err := parseKeyRange(r, req.startTime, req.endTime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cols, err := req.loadColumns()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cols == nil {
+		return
+	}
+
+	rr := rangeRegions(start, end, cols.regions)
+	h := newHeatmap(rr, cols.times[0], cols.times[len(cols.times)-1], req.buckets, req.squash, req.metrics)
+	h.Labels = labels
+
+	writeJSON(w, req.output(cols, []Heatmap{h}))
+}
+
+type outHotspots struct {
+	StartTime time.Time `json:"start"`
+	EndTime   time.Time `json:"end"`
+	Unit      string    `json:"unit"`
+	Tag       string    `json:"tag"`
+	Threshold uint64    `json:"threshold"`
+
+	Hotspots []Hotspot `json:"hotspots"`
+}
+
+// hotspotsHandler ranks the regions by the load of the first tag in the
+// window, limit=10 returns the top 10 ones. The range is hot when its value
+// is above threshold, which is the 90th percentile of all the values if
+// not given.
+func hotspotsHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := parseHeatmapRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := 10
+	if v := r.FormValue("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	var threshold uint64
+	hasThreshold := false
+	if v := r.FormValue("threshold"); v != "" {
+		if threshold, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid threshold %q", v), http.StatusBadRequest)
+			return
+		}
+		hasThreshold = true
+	}
+
+	cols, err := req.loadColumns()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cols == nil {
+		return
+	}
+
+	m := req.metrics[0]
+	rs := buildRanges(cols.regions)
+	values := m.deriveValues(calCounterValues(rs, cols.regions, req.metrics[:1]))
+	if !hasThreshold {
+		threshold = percentile(values, cols.isGap, 0.9)
+	}
+
+	startTime, endTime := cols.times[0], cols.times[len(cols.times)-1]
+	hotspots := findHotspots(rs, values, cols.isGap, startTime, endTime, threshold, limit)
+	spans := tableSpans(loadTablesAt(startTime, endTime))
+	for i := range hotspots {
+		hotspots[i].Labels = coveredLabels(spans, hotspots[i].StartKey.Desc, hotspots[i].EndKey.Desc)
+	}
+
+	writeJSON(w, outHotspots{
+		StartTime: cols.times[0].In(req.loc),
+		EndTime:   cols.times[len(cols.times)-1].In(req.loc),
+		Unit:      cols.unit.String(),
+		Tag:       m.name,
+		Threshold: threshold,
+		Hotspots:  hotspots,
+	})
+}
+
+type outStatus struct {
+	SchemaVersion      int64     `json:"schema_version"`
+	SchemaLoadedAt     time.Time `json:"schema_loaded_at"`
+	SchemaLoadDuration string    `json:"schema_load_duration"`
+	Tables             int       `json:"tables"`
+}
+
+// statusHandler shows the schema version the tables are loaded at.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	version, loadedAt, loadDuration := schema.get()
+	writeJSON(w, outStatus{
+		SchemaVersion:      version,
+		SchemaLoadedAt:     loadedAt,
+		SchemaLoadDuration: loadDuration.String(),
+		Tables:             len(loadTables()),
+	})
+}
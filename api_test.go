@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+func encodeKey(key []byte) string {
+	return strings.ToUpper(hex.EncodeToString(codec.EncodeBytes(nil, key)))
+}
+
+func TestParseKeyRange(t *testing.T) {
+	oldTables := tables
+	defer func() { tables = oldTables }()
+	tables = newTableHistory()
+	tables.update(1, []*Table{
+		{ID: 10, DB: "test", Name: "t", Indices: map[int64]string{2: "idx"}},
+		{ID: 20, DB: "test", Name: "pt", Partitions: []Partition{{ID: 21, Name: "p0"}, {ID: 22, Name: "p1"}}},
+	}, time.Now())
+
+	check := func(query string, start string, end string, labels []string) {
+		r := httptest.NewRequest("GET", "/heatmaps/range?"+query, nil)
+		s, e, l, err := parseKeyRange(r, time.Now(), time.Now())
+		if err != nil {
+			t.Fatalf("unexpected error %v for %s", err, query)
+		}
+		if s != start || e != end || !reflect.DeepEqual(l, labels) {
+			t.Fatalf("want [%s, %s) %v, but got [%s, %s) %v for %s", start, end, labels, s, e, l, query)
+		}
+	}
+
+	check("start_key=7480&end_key=7481", "7480", "7481", nil)
+	check("start_key=7480", "7480", "", nil)
+	check("table=10",
+		encodeKey(tablecodec.GenTableRecordPrefix(10)), encodeKey(tablecodec.EncodeTablePrefix(11)),
+		[]string{"test", "t", ""})
+	check("table=10&index=2",
+		encodeKey(tablecodec.EncodeTableIndexPrefix(10, 2)), encodeKey(tablecodec.EncodeTableIndexPrefix(10, 3)),
+		[]string{"test", "t", "idx"})
+	check("table=11&start_handle=-5&end_handle=100",
+		encodeKey(tablecodec.EncodeRowKeyWithHandle(11, -5)), encodeKey(tablecodec.EncodeRowKeyWithHandle(11, 100)),
+		[]string{"", "11", ""})
+	// the partition by the name or the ID
+	check("table=20&partition=p1",
+		encodeKey(tablecodec.GenTableRecordPrefix(22)), encodeKey(tablecodec.EncodeTablePrefix(23)),
+		[]string{"test", "pt.p1", ""})
+	check("table=21",
+		encodeKey(tablecodec.GenTableRecordPrefix(21)), encodeKey(tablecodec.EncodeTablePrefix(22)),
+		[]string{"test", "pt.p0", ""})
+
+	for _, query := range []string{
+		"start_key=xyz",
+		"start_key=7481&end_key=7480",
+		"table=abc",
+		"table=10&index=x",
+		"table=10&start_handle=5&end_handle=1",
+		"table=20",
+		"table=20&partition=p2",
+	} {
+		r := httptest.NewRequest("GET", "/heatmaps/range?"+query, nil)
+		if _, _, _, err := parseKeyRange(r, time.Now(), time.Now()); err == nil {
+			t.Fatalf("expect error for %s", query)
+		}
+	}
+}
+
+func TestRangeHandler(t *testing.T) {
+	old := stat
+	defer func() { stat = old }()
+
+	s := newRingStatStore(10)
+	stat = s
+	s.append(&Stat{
+		Time: time.Now(),
+		Regions: []*regionInfo{
+			newRegionInfo("", GenTableRecordKey(1, 100), 10),
+			newRegionInfo(GenTableRecordKey(1, 100), GenTableRecordKey(1, 200), 20),
+			newRegionInfo(GenTableRecordKey(1, 200), GenTablePrefix(2), 30),
+			newRegionInfo(GenTablePrefix(2), "", 40),
+		},
+	})
+
+	w := httptest.NewRecorder()
+	rangeHandler(w, httptest.NewRequest("GET", "/heatmaps/range?start=-1m&table=1&start_handle=100&end_handle=300&N=1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body)
+	}
+
+	var out outStat
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Heatmaps) != 1 || !reflect.DeepEqual(out.Heatmaps[0].Values, [][]uint64{{50}}) {
+		t.Fatalf("unexpected heatmaps %v", out.Heatmaps)
+	}
+
+	w = httptest.NewRecorder()
+	rangeHandler(w, httptest.NewRequest("GET", "/heatmaps/range?N=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expect bad request, but got %d", w.Code)
+	}
+}
+
+func TestParseHeatmapTime(t *testing.T) {
+	parse := func(query string) (*heatmapRequest, error) {
+		return parseHeatmapRequest(httptest.NewRequest("GET", "/heatmaps?"+query, nil))
+	}
+
+	req, err := parse("start=1767225600&end=2026-01-01T10:00:00Z&tz=%2B08:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !req.startTime.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) || !req.endTime.Equal(time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected window [%s, %s]", req.startTime, req.endTime)
+	}
+	if _, offset := req.endTime.In(req.loc).Zone(); offset != 8*3600 {
+		t.Fatalf("unexpected offset %d", offset)
+	}
+
+	// in milliseconds, and without the zone in tz
+	req, err = parse("start=1767225600000&end=2026-01-01T10:00:00&tz=UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !req.startTime.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) || !req.endTime.Equal(time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected window [%s, %s]", req.startTime, req.endTime)
+	}
+
+	req, err = parse("start=-10m&end=-5m")
+	if err != nil || req.endTime.Sub(req.startTime) != 5*time.Minute {
+		t.Fatalf("unexpected window %v %v", req, err)
+	}
+
+	for _, query := range []string{"start=yesterday", "end=2026-13-01T00:00:00Z", "tz=Mars/Base", "start=-1m&end=-10m"} {
+		if _, err := parse(query); err == nil {
+			t.Fatalf("expect error for %s", query)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/heatmaps?start=yesterday", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid start") {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHeatmapsPadGaps(t *testing.T) {
+	old := stat
+	defer func() { stat = old }()
+	s := newRingStatStore(10)
+	stat = s
+
+	// the collector has been down for the last 30 minutes
+	now := time.Now()
+	s.append(&Stat{Time: now.Add(-30 * time.Minute), Regions: []*regionInfo{newRegionInfo("", "", 10)}})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/heatmaps?scope=cluster&start=-60m", nil))
+	var out outStat
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	first, last := out.Times[0], out.Times[len(out.Times)-1]
+	if first.Before(now.Add(-60*time.Minute)) || first.After(now.Add(-59*time.Minute)) || last.Before(now.Add(-time.Minute)) {
+		t.Fatalf("unexpected times from %s to %s", first, last)
+	}
+	if len(out.Times) != 59 || len(out.Gaps) != 58 {
+		t.Fatalf("unexpected %d columns with %d gaps", len(out.Times), len(out.Gaps))
+	}
+}
@@ -70,6 +70,14 @@ func EncodeInt(b []byte, v int64) []byte {
 	return append(b, data[:]...)
 }
 
+// GenTablePrefix composes table prefix with tableID: "t[tableID]".
+func GenTablePrefix(tableID int64) string {
+	buf := make([]byte, 0, len(tablePrefix)+8)
+	buf = append(buf, tablePrefix...)
+	buf = EncodeInt(buf, tableID)
+	return strings.ToUpper(hex.EncodeToString(EncodeBytes(buf)))
+}
+
 // GenTableRecordPrefix composes record prefix with tableID: "t[tableID]_r".
 func GenTableRecordPrefix(tableID int64) string {
 	buf := make([]byte, 0, len(tablePrefix)+8+len(recordPrefixSep))
@@ -77,6 +85,14 @@ func GenTableRecordPrefix(tableID int64) string {
 	return strings.ToUpper(hex.EncodeToString(EncodeBytes(buf)))
 }
 
+// GenTableRecordKey composes record key with tableID and handle: "t[tableID]_r[handle]".
+func GenTableRecordKey(tableID int64, handle int64) string {
+	buf := make([]byte, 0, len(tablePrefix)+8+len(recordPrefixSep)+8)
+	buf = appendTableRecordPrefix(buf, tableID)
+	buf = EncodeInt(buf, handle)
+	return strings.ToUpper(hex.EncodeToString(EncodeBytes(buf)))
+}
+
 // GenTableIndexPrefix composes index prefix with tableID: "t[tableID]_i".
 func GenTableIndexPrefix(tableID int64, idx int64) string {
 	buf := make([]byte, 0, len(tablePrefix)+8+len(indexPrefixSep)+8)
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+// rowIDColumn is the hidden handle of the tables without an integer
+// primary key.
+const rowIDColumn = "_tidb_rowid"
+
+// Column is a column of an index or the clustered primary key.
+type Column struct {
+	Name string
+	Type types.FieldType
+}
+
+// formatDatum formats the datum decoded from a key by the type of its
+// column, as the key only keeps the raw kind like uint64 for the time.
+func formatDatum(d types.Datum, ft *types.FieldType) string {
+	if d.IsNull() {
+		return "NULL"
+	}
+
+	switch ft.Tp {
+	case mysql.TypeDate, mysql.TypeDatetime, mysql.TypeTimestamp:
+		t := types.Time{Type: ft.Tp, Fsp: ft.Decimal}
+		if err := t.FromPackedUint(d.GetUint64()); err == nil {
+			return t.String()
+		}
+	case mysql.TypeDuration:
+		if d.Kind() == types.KindMysqlDuration {
+			dur := d.GetMysqlDuration()
+			dur.Fsp = ft.Decimal
+			return dur.String()
+		}
+		return types.Duration{Duration: time.Duration(d.GetInt64()), Fsp: ft.Decimal}.String()
+	case mysql.TypeEnum:
+		if e, err := types.ParseEnumValue(ft.Elems, d.GetUint64()); err == nil {
+			return strconv.Quote(e.String())
+		}
+	case mysql.TypeSet:
+		if s, err := types.ParseSetValue(ft.Elems, d.GetUint64()); err == nil {
+			return strconv.Quote(s.String())
+		}
+	}
+
+	s, err := d.ToString()
+	if err != nil {
+		return fmt.Sprintf("%v", d.GetValue())
+	}
+	if d.Kind() == types.KindBytes || d.Kind() == types.KindString {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// formatIndexValues formats the encoded values of an index key like
+// (user_id=42, created_at=2026-01-01). The values after the columns are
+// the handle of the non-unique index. The key of a region boundary may be
+// cut in the middle, only the values decoded are formatted.
+func formatIndexValues(b []byte, cols []Column, handle string) string {
+	var values []string
+	for i := 0; len(b) > 0; i++ {
+		remain, d, err := codec.DecodeOne(b)
+		if err != nil {
+			break
+		}
+		b = remain
+
+		if i < len(cols) {
+			values = append(values, fmt.Sprintf("%s=%s", cols[i].Name, formatDatum(d, &cols[i].Type)))
+		} else {
+			s, _ := d.ToString()
+			values = append(values, fmt.Sprintf("%s=%s", handle, s))
+		}
+	}
+	return "(" + strings.Join(values, ", ") + ")"
+}
+
+// handleName returns the name of the handle column of the table.
+func handleName(t *Table) string {
+	if t.Handle == "" {
+		return rowIDColumn
+	}
+	return t.Handle
+}
+
+// isEncodedValues reports whether b is made of the encoded values, which
+// an int64 handle is not likely to be.
+func isEncodedValues(b []byte) bool {
+	for len(b) > 0 {
+		remain, _, err := codec.DecodeOne(b)
+		if err != nil {
+			return false
+		}
+		b = remain
+	}
+	return true
+}
+
+// decodeHandle decodes the handle of a record key, which is an int64 or the
+// encoded values of the clustered primary key of the table. The type is
+// guessed if the table is unknown.
+func decodeHandle(b []byte, t *Table) (handleType string, rowID int64, row string) {
+	if len(b) == 0 {
+		return "", 0, ""
+	}
+
+	common := len(b) != 8 && isEncodedValues(b)
+	if t != nil {
+		common = t.IsCommonHandle
+	}
+	if common {
+		if t != nil && t.CommonHandle != nil {
+			row = formatIndexValues(b, t.CommonHandle, rowIDColumn)
+		}
+		return "common", 0, row
+	}
+
+	if len(b) < 8 {
+		return "", 0, ""
+	}
+	_, rowID, _ = codec.DecodeInt(b)
+	if t != nil {
+		row = fmt.Sprintf("(%s=%d)", handleName(t), rowID)
+	}
+	return "int", rowID, row
+}
+
+// escapeBytes escapes the bytes like t\x80\x00\x01, only the printable
+// ASCII characters are kept.
+func escapeBytes(b []byte) string {
+	var buf strings.Builder
+	for _, c := range b {
+		switch {
+		case c == '\\' || c == '"':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c >= 0x20 && c < 0x7f:
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, `\x%02x`, c)
+		}
+	}
+	return buf.String()
+}
+
+// decodeKey decodes the hex encoded key of a region boundary by the tables
+// live in [startTime, endTime]. It never fails, the key is returned with the
+// escaped bytes and the error if it can not be decoded.
+func decodeKey(key string, startTime time.Time, endTime time.Time) Key {
+	k := Key{Desc: key}
+	v, err := hex.DecodeString(key)
+	if err != nil {
+		k.Kind, k.Error, k.Raw = "unknown", err.Error(), escapeBytes([]byte(key))
+		return k
+	}
+	if len(v) == 0 {
+		// the start or the end of the key space
+		k.Kind = "raw"
+		return k
+	}
+
+	tsBytes, b, err := codec.DecodeBytes(v, nil)
+	if err != nil {
+		// not in the memcomparable format, like the keys of the raw KV
+		k.Kind, k.Raw = "raw", escapeBytes(v)
+		return k
+	}
+	if len(tsBytes) == 8 {
+		_, k.Ts, _ = codec.DecodeUintDesc(tsBytes)
+	}
+	if len(b) > 0 && b[0] == 'z' {
+		b = b[1:]
+	}
+
+	switch {
+	case bytes.HasPrefix(b, tablePrefix):
+		decodeTableKey(&k, b, startTime, endTime)
+	case bytes.HasPrefix(b, []byte("m")):
+		k.Kind, k.Raw = "meta", escapeBytes(b)
+	default:
+		k.Kind, k.Raw = "raw", escapeBytes(b)
+	}
+	return k
+}
+
+// decodeTableKey decodes the key of the records or the indices, the values
+// are typed by the columns of the table if it is live in [startTime, endTime].
+func decodeTableKey(k *Key, b []byte, startTime time.Time, endTime time.Time) {
+	fail := func(err error) {
+		k.Error, k.Raw = err.Error(), escapeBytes(b)
+	}
+
+	rest, tableID, err := codec.DecodeInt(b[len(tablePrefix):])
+	if err != nil {
+		k.Kind = "unknown"
+		fail(fmt.Errorf("invalid table ID: %v", err))
+		return
+	}
+	k.TableID = tableID
+	t, _ := tables.at(tableID, startTime, endTime)
+
+	switch {
+	case len(rest) == 0:
+		k.Kind = "table"
+	case bytes.HasPrefix(rest, recordPrefixSep):
+		k.Kind = "record"
+		handle := rest[len(recordPrefixSep):]
+		k.HandleType, k.RowID, k.Row = decodeHandle(handle, t)
+		if len(handle) > 0 && k.HandleType == "" {
+			fail(errors.New("invalid handle"))
+		}
+	case bytes.HasPrefix(rest, indexPrefixSep):
+		k.Kind = "index"
+		values, indexID, err := codec.DecodeInt(rest[len(indexPrefixSep):])
+		if err != nil {
+			fail(fmt.Errorf("invalid index ID: %v", err))
+			return
+		}
+		k.IndexID = indexID
+
+		for remain := values; len(remain) > 0; {
+			var d types.Datum
+			if remain, d, err = codec.DecodeOne(remain); err != nil {
+				fail(fmt.Errorf("invalid index values: %v", err))
+				break
+			}
+			k.IndexValues = append(k.IndexValues, fmt.Sprintf("%d-%v", d.Kind(), d.GetValue()))
+		}
+		if t != nil && len(values) > 0 {
+			if cols, ok := t.IndexColumns[indexID]; ok {
+				k.Row = formatIndexValues(values, cols, handleName(t))
+			}
+		}
+	default:
+		k.Kind = "unknown"
+		fail(errors.New("neither a record nor an index key"))
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/sessionctx/stmtctx"
+	"github.com/pingcap/tidb/tablecodec"
+	"github.com/pingcap/tidb/types"
+	"github.com/pingcap/tidb/util/codec"
+)
+
+func TestDecodeTypedKey(t *testing.T) {
+	oldTables := tables
+	defer func() { tables = oldTables }()
+	tables = newTableHistory()
+	tables.update(1, []*Table{{
+		ID: 40, DB: "test", Name: "orders",
+		Indices: map[int64]string{1: "idx"},
+		IndexColumns: map[int64][]Column{1: {
+			{Name: "user_id", Type: *types.NewFieldType(mysql.TypeLonglong)},
+			{Name: "created_at", Type: *types.NewFieldType(mysql.TypeDate)},
+			{Name: "note", Type: *types.NewFieldType(mysql.TypeVarchar)},
+		}},
+		Handle: "id",
+	}}, time.Now())
+
+	date := types.Time{Time: types.FromDate(2026, 1, 1, 0, 0, 0, 0), Type: mysql.TypeDate}
+	sc := &stmtctx.StatementContext{TimeZone: time.UTC}
+	values, err := codec.EncodeKey(sc, nil, types.NewIntDatum(42), types.NewTimeDatum(date), types.NewStringDatum("a"), types.NewIntDatum(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(key string, expected string) {
+		if k := decodeKey(key, time.Now(), time.Now()); k.Row != expected {
+			t.Fatalf("want %s, but got %s", expected, k.Row)
+		}
+	}
+
+	check(encodeKey(tablecodec.EncodeIndexSeekKey(40, 1, values)), `(user_id=42, created_at=2026-01-01, note="a", id=7)`)
+	// the boundary cut after the first column
+	first, _ := codec.EncodeKey(sc, nil, types.NewIntDatum(42))
+	check(encodeKey(tablecodec.EncodeIndexSeekKey(40, 1, first)), "(user_id=42)")
+	check(encodeKey(tablecodec.EncodeRowKeyWithHandle(40, 5)), "(id=5)")
+	// unknown table
+	check(encodeKey(tablecodec.EncodeRowKeyWithHandle(41, 5)), "")
+}
+
+func TestDecodeCommonHandle(t *testing.T) {
+	oldTables := tables
+	defer func() { tables = oldTables }()
+	tables = newTableHistory()
+	tables.update(1, []*Table{{
+		ID: 50, DB: "test", Name: "users",
+		IsCommonHandle: true,
+		CommonHandle: []Column{
+			{Name: "name", Type: *types.NewFieldType(mysql.TypeVarchar)},
+			{Name: "age", Type: *types.NewFieldType(mysql.TypeLonglong)},
+		},
+	}, {
+		ID: 52, DB: "test", Name: "untyped",
+		IsCommonHandle: true,
+	}}, time.Now())
+
+	sc := &stmtctx.StatementContext{TimeZone: time.UTC}
+	handle, err := codec.EncodeKey(sc, nil, types.NewStringDatum("bob"), types.NewIntDatum(30))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := decodeKey(encodeKey(tablecodec.EncodeRowKey(50, handle)), time.Now(), time.Now())
+	if k.HandleType != "common" || k.RowID != 0 || k.Row != `(name="bob", age=30)` {
+		t.Fatalf("unexpected key %+v", k)
+	}
+	// the columns of the primary key are unknown
+	k = decodeKey(encodeKey(tablecodec.EncodeRowKey(52, handle)), time.Now(), time.Now())
+	if k.HandleType != "common" || k.Row != "" || k.Error != "" {
+		t.Fatalf("unexpected key %+v", k)
+	}
+
+	// the type is guessed for the unknown table
+	k = decodeKey(encodeKey(tablecodec.EncodeRowKey(51, handle)), time.Now(), time.Now())
+	if k.HandleType != "common" || k.RowID != 0 {
+		t.Fatalf("unexpected key %+v", k)
+	}
+	k = decodeKey(encodeKey(tablecodec.EncodeRowKeyWithHandle(51, 5)), time.Now(), time.Now())
+	if k.HandleType != "int" || k.RowID != 5 {
+		t.Fatalf("unexpected key %+v", k)
+	}
+}
+
+func TestDecodeKeyKinds(t *testing.T) {
+	check := func(key string, kind string, hasError bool, raw string) {
+		k := decodeKey(key, time.Now(), time.Now())
+		if k.Kind != kind || (k.Error != "") != hasError || k.Raw != raw {
+			t.Fatalf("want %s %v %q, but got %+v for %s", kind, hasError, raw, k, key)
+		}
+	}
+
+	check("", "raw", false, "")
+	check("xyz", "unknown", true, "xyz")
+	// not memcomparable
+	check(hex.EncodeToString([]byte("foo\x01")), "raw", false, `foo\x01`)
+	check(encodeKey([]byte("mDB:1")), "meta", false, "mDB:1")
+	check(encodeKey([]byte("abc")), "raw", false, "abc")
+	check(encodeKey([]byte("t\x80")), "unknown", true, `t\x80`)
+	check(encodeKey(tablecodec.EncodeRowKeyWithHandle(1, 2)), "record", false, "")
+	check(encodeKey(append(tablecodec.EncodeTableIndexPrefix(1, 2), 0xff)), "index", true, `t\x80\x00\x00\x00\x00\x00\x00\x01_i\x80\x00\x00\x00\x00\x00\x00\x02\xff`)
+	check(encodeKey(append(tablecodec.EncodeTablePrefix(1), 'x')), "unknown", true, `t\x80\x00\x00\x00\x00\x00\x00\x01x`)
+}
+
+func TestDecodeKeyInWindow(t *testing.T) {
+	oldTables := tables
+	defer func() { tables = oldTables }()
+	tables = newTableHistory()
+
+	now := time.Now()
+	tbl := &Table{
+		ID: 60, DB: "test", Name: "t", Handle: "id",
+		Indices:      map[int64]string{1: "idx"},
+		IndexColumns: map[int64][]Column{1: {{Name: "a", Type: *types.NewFieldType(mysql.TypeLonglong)}}},
+	}
+	tables.update(1, []*Table{tbl}, now.Add(-time.Hour))
+	tables.keepDBs(map[int64]struct{}{1: {}}, now.Add(-time.Hour))
+	// the index is replaced by one on another column
+	tables.update(1, []*Table{{
+		ID: 60, DB: "test", Name: "t", Handle: "id",
+		Indices:      map[int64]string{1: "idx"},
+		IndexColumns: map[int64][]Column{1: {{Name: "b", Type: *types.NewFieldType(mysql.TypeLonglong)}}},
+	}}, now.Add(-10*time.Minute))
+
+	sc := &stmtctx.StatementContext{TimeZone: time.UTC}
+	values, err := codec.EncodeKey(sc, nil, types.NewIntDatum(42))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := encodeKey(tablecodec.EncodeIndexSeekKey(60, 1, values))
+
+	if k := decodeKey(key, now.Add(-time.Hour), now.Add(-30*time.Minute)); k.Row != "(a=42)" {
+		t.Fatalf("want the old schema, but got %+v", k)
+	}
+	if k := decodeKey(key, now.Add(-5*time.Minute), now); k.Row != "(b=42)" {
+		t.Fatalf("want the new schema, but got %+v", k)
+	}
+}
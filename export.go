@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// describeKey describes the decoded key like t40_r(id=5) or t40_i1(a=1),
+// or the escaped bytes of the other keys.
+func describeKey(k Key) string {
+	switch k.Kind {
+	case "table":
+		return fmt.Sprintf("t%d", k.TableID)
+	case "record":
+		handle := k.Row
+		if handle == "" && k.HandleType == "int" {
+			handle = strconv.FormatInt(k.RowID, 10)
+		}
+		return fmt.Sprintf("t%d_r%s", k.TableID, handle)
+	case "index":
+		return fmt.Sprintf("t%d_i%d%s", k.TableID, k.IndexID, k.Row)
+	default:
+		return k.Raw
+	}
+}
+
+// exportRow is a bucket in a column of a heatmap.
+type exportRow struct {
+	Time     time.Time         `json:"time"`
+	DB       string            `json:"db"`
+	Table    string            `json:"table"`
+	Index    string            `json:"index"`
+	StartKey string            `json:"start_key"`
+	EndKey   string            `json:"end_key"`
+	Start    string            `json:"start"`
+	End      string            `json:"end"`
+	Value    uint64            `json:"value"`
+	Metrics  map[string]uint64 `json:"metrics,omitempty"`
+}
+
+// writeRows streams the heatmaps in CSV or NDJSON, a row for every bucket
+// in every column which is not a gap. The heatmaps are built and written
+// one table at a time, until writing fails or ctx is done.
+func writeRows(ctx context.Context, w http.ResponseWriter, format string, req *heatmapRequest, sc *heatmapScope, cols *statColumns) error {
+	var names []string
+	if len(req.metrics) > 1 {
+		for _, m := range req.metrics {
+			names = append(names, m.name)
+		}
+	}
+
+	var write func(row *exportRow) error
+	var flush func() error
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		cw := csv.NewWriter(w)
+		header := []string{"time", "db", "table", "index", "start_key", "end_key", "start", "end", "value"}
+		cw.Write(append(header, names...))
+
+		record := make([]string, len(header)+len(names))
+		write = func(row *exportRow) error {
+			record = append(record[:0], row.Time.Format(time.RFC3339), row.DB, row.Table, row.Index,
+				row.StartKey, row.EndKey, row.Start, row.End, strconv.FormatUint(row.Value, 10))
+			for _, name := range names {
+				record = append(record, strconv.FormatUint(row.Metrics[name], 10))
+			}
+			return cw.Write(record)
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		write = func(row *exportRow) error {
+			return enc.Encode(row)
+		}
+		flush = func() error { return nil }
+	}
+
+	if cols != nil {
+		err := sc.each(req, cols, func(heatmaps []Heatmap) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			out := req.output(cols, heatmaps)
+			for _, h := range out.Heatmaps {
+				if err := writeHeatmapRows(h, out, names, write); err != nil {
+					return err
+				}
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return flush()
+}
+
+func writeHeatmapRows(h Heatmap, out outStat, names []string, write func(row *exportRow) error) error {
+	gaps := make(map[int]struct{}, len(out.Gaps))
+	for _, i := range out.Gaps {
+		gaps[i] = struct{}{}
+	}
+
+	row := &exportRow{}
+	if len(h.Labels) == 3 {
+		row.DB, row.Table, row.Index = h.Labels[0], h.Labels[1], h.Labels[2]
+	}
+	if len(names) > 0 {
+		row.Metrics = make(map[string]uint64, len(names))
+	}
+	for i, r := range h.Ranges {
+		row.StartKey, row.EndKey = r.StartKey.Desc, r.EndKey.Desc
+		row.Start, row.End = describeKey(r.StartKey), describeKey(r.EndKey)
+		for j, t := range out.Times {
+			if _, ok := gaps[j]; ok {
+				continue
+			}
+			row.Time = t
+			row.Value = h.Values[i][j]
+			for _, name := range names {
+				row.Metrics[name] = h.Metrics[name][i][j]
+			}
+			if err := write(row); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestExportRows(t *testing.T) {
+	old := stat
+	defer func() { stat = old }()
+	s := newRingStatStore(10)
+	stat = s
+
+	oldTables := tables
+	defer func() { tables = oldTables }()
+	tables = newTableHistory()
+	tables.update(1, []*Table{{ID: 1, DB: "test", Name: "t", Handle: "id"}}, time.Now())
+
+	now := time.Now().Truncate(time.Second)
+	for i, v := range []uint64{10, 20} {
+		s.append(&Stat{
+			Time: now.Add(time.Duration(i-2) * time.Minute),
+			Regions: []*regionInfo{
+				newRegionInfo("", GenTableRecordPrefix(1), 1),
+				newRegionInfo(GenTableRecordPrefix(1), GenTableRecordKey(1, 100), 1),
+				newRegionInfo(GenTableRecordKey(1, 100), GenTableRecordPrefix(2), v),
+				newRegionInfo(GenTableRecordPrefix(2), "", 1),
+			},
+		})
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/heatmaps?start=-5m&format=csv&tz=UTC", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body)
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the header and 2 buckets in 2 columns
+	if len(records) != 5 {
+		t.Fatalf("unexpected records %v", records)
+	}
+	expected := []string{now.Add(-2 * time.Minute).UTC().Format(time.RFC3339), "test", "t", "", GenTableRecordPrefix(1), GenTableRecordKey(1, 100), "t1_r", "t1_r(id=100)", "1"}
+	if !reflect.DeepEqual(records[1], expected) {
+		t.Fatalf("want %v, but got %v", expected, records[1])
+	}
+	if records[4][8] != "20" {
+		t.Fatalf("unexpected record %v", records[4])
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/heatmaps?start=-5m&format=ndjson&tag=written_bytes,read_bytes", nil))
+	scanner := bufio.NewScanner(w.Body)
+	var rows []exportRow
+	for scanner.Scan() {
+		var row exportRow
+		if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) != 4 || rows[3].Value != 20 || rows[3].Metrics["written_bytes"] != 20 || rows[3].Start != "t1_r(id=100)" {
+		t.Fatalf("unexpected rows %v", rows)
+	}
+
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/heatmaps?format=xml", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expect bad request, but got %d", w.Code)
+	}
+}
+
+// failedWriter fails every write and counts them.
+type failedWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *failedWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return 0, errors.New("broken pipe")
+}
+
+func TestExportRowsStop(t *testing.T) {
+	old := stat
+	defer func() { stat = old }()
+	s := newRingStatStore(10)
+	stat = s
+
+	oldTables := tables
+	defer func() { tables = oldTables }()
+	tables = newTableHistory()
+	tables.update(1, []*Table{{ID: 1, DB: "test", Name: "t1", Handle: "id"}, {ID: 2, DB: "test", Name: "t2", Handle: "id"}}, time.Now())
+
+	now := time.Now().Truncate(time.Second)
+	for i := 0; i < 2; i++ {
+		s.append(&Stat{
+			Time: now.Add(time.Duration(i-2) * time.Minute),
+			Regions: []*regionInfo{
+				newRegionInfo("", GenTableRecordPrefix(1), 1),
+				newRegionInfo(GenTableRecordPrefix(1), GenTableRecordPrefix(2), 1),
+				newRegionInfo(GenTableRecordPrefix(2), GenTableRecordPrefix(3), 1),
+				newRegionInfo(GenTableRecordPrefix(3), "", 1),
+			},
+		})
+	}
+
+	w := &failedWriter{ResponseRecorder: httptest.NewRecorder()}
+	handler(w, httptest.NewRequest("GET", "/heatmaps?start=-5m&format=ndjson", nil))
+	if w.writes != 1 {
+		t.Fatalf("want 1 write, but got %d", w.writes)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rw := httptest.NewRecorder()
+	handler(rw, httptest.NewRequest("GET", "/heatmaps?start=-5m&format=csv", nil).WithContext(ctx))
+	if rw.Body.Len() != 0 {
+		t.Fatalf("unexpected rows %s", rw.Body)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// sysSchemas are skipped if -no-sys is set.
+var sysSchemas = []string{"mysql.*", "INFORMATION_SCHEMA.*", "PERFORMANCE_SCHEMA.*", "METRICS_SCHEMA.*"}
+
+// parsePatterns parses the comma separated patterns, a pattern is a glob
+// like "test.*", or a regexp between slashes like "/^tmp_/". Both are case
+// insensitive, and the glob must match the whole name.
+func parsePatterns(s string) ([]*regexp.Regexp, error) {
+	var patterns []*regexp.Regexp
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		expr := p
+		if len(p) > 1 && strings.HasPrefix(p, "/") && strings.HasSuffix(p, "/") {
+			expr = p[1 : len(p)-1]
+		} else {
+			expr = regexp.QuoteMeta(p)
+			expr = strings.Replace(expr, `\*`, ".*", -1)
+			expr = strings.Replace(expr, `\?`, ".", -1)
+			expr = "^" + expr + "$"
+		}
+
+		re, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", p, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+func matchAny(patterns []*regexp.Regexp, name string) bool {
+	for _, p := range patterns {
+		if p.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// tableFilter selects the tables by the patterns of db.table, a table is
+// kept if it matches any include pattern, or there is none, and matches no
+// exclude pattern.
+type tableFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+func newTableFilter(include string, exclude string) (*tableFilter, error) {
+	in, err := parsePatterns(include)
+	if err != nil {
+		return nil, err
+	}
+	ex, err := parsePatterns(exclude)
+	if err != nil {
+		return nil, err
+	}
+	return &tableFilter{include: in, exclude: ex}, nil
+}
+
+func (f *tableFilter) match(t *Table) bool {
+	if f == nil {
+		return true
+	}
+
+	name := t.String()
+	if len(f.include) > 0 && !matchAny(f.include, name) {
+		return false
+	}
+	return !matchAny(f.exclude, name)
+}
+
+func (f *tableFilter) filter(tbls []*Table) []*Table {
+	if f == nil {
+		return tbls
+	}
+
+	newTbls := make([]*Table, 0, len(tbls))
+	for _, t := range tbls {
+		if f.match(t) {
+			newTbls = append(newTbls, t)
+		}
+	}
+	return newTbls
+}
+
+// filters are the tables to build the heatmaps, check the alerts and export
+// the metrics for.
+var filters *tableFilter
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTableFilter(t *testing.T) {
+	tbls := []*Table{
+		{DB: "mysql", Name: "user"},
+		{DB: "INFORMATION_SCHEMA", Name: "TABLES"},
+		{DB: "test", Name: "t1"},
+		{DB: "test", Name: "t2"},
+		{DB: "tmp_1", Name: "t"},
+		{DB: "app", Name: "orders"},
+	}
+
+	check := func(include string, exclude string, expected []string) {
+		f, err := newTableFilter(include, exclude)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, tbl := range f.filter(tbls) {
+			names = append(names, tbl.String())
+		}
+		if !reflect.DeepEqual(names, expected) {
+			t.Fatalf("want %v, but got %v for include %q and exclude %q", expected, names, include, exclude)
+		}
+	}
+
+	check("", strings.Join(sysSchemas, ","), []string{"test.t1", "test.t2", "tmp_1.t", "app.orders"})
+	check("test.*", "", []string{"test.t1", "test.t2"})
+	check("test.*, app.*", "*.t2", []string{"test.t1", "app.orders"})
+	check("", "/^tmp_/,information_schema.*,mysql.*", []string{"test.t1", "test.t2", "app.orders"})
+	check("test.t?", "", []string{"test.t1", "test.t2"})
+
+	// the nil filter keeps all
+	var f *tableFilter
+	if len(f.filter(tbls)) != len(tbls) {
+		t.Fatal("expect all tables kept")
+	}
+
+	if _, err := newTableFilter("/(/", ""); err == nil {
+		t.Fatal("expect error for invalid regexp")
+	}
+}
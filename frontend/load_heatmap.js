@@ -1,159 +1,21 @@
 /*
   change your API host here
-  we use convert python third-party module to convert our array-like data to 
-  matrix which is needed for heatmap visualizer
+  keyvisual builds the clustergrammer network of the heatmaps by format=viz
 */
 
-const tickDataAPIPrefix = '/heatmaps?start=-60m&tag='
-var rawInfo,
-  allRanges = []
+const tickDataAPIPrefix = '/heatmaps?start=-60m&format=viz&tag='
+var allRanges = []
 var heatmapType = 'written_bytes'
 
 let ctime = 0,
   switches = {}
 
-/* 
-  leave it alone, or set it up by yourself
-  install the requirements.txt by pip, and run `python server`
-*/
-
 function getData(type) {
-  return fetch(tickDataAPIPrefix + type)
-    .then(res => res.json())
-    .then(json => {
-      rawInfo = json
-      try {
-        const tl =
-          // '\t' +
-          // '\t\t\t' +
-          json.heatmaps[0].values[0].map((i, idx) => {
-            return idx + 'm'
-            // return 'time-' + idx
-          })
-        // .join('\t')
-
-        let dlines = [],
-          b_num = 0
-        json.heatmaps.forEach(h => {
-          h.ranges.forEach((i, idx) => {
-            const ds = h.labels[2] ? 'index ' + h.labels[2] : 'Data'
-            dlines.push(
-              [
-                `Bucket: bucket-${b_num}`,
-                'DB: ' + h.labels[0],
-                'Table: ' + h.labels[1],
-                'Data Type: ' + ds, //? h.labels[2] : 'DATA',
-                ...h.values[idx].map(i => i + 1)
-              ]
-              // .join('\t')
-            )
-            b_num += 1
-          })
-        })
-
-        // return tl + '\n' + dlines.join('\n')
-        return [tl, ...dlines]
-      } catch (e) {}
-    })
+  return fetch(tickDataAPIPrefix + type).then(res => res.json())
 }
 
 var about_string = ''
 
-function getClusterColors(dlines) {
-  const all_colors = [
-    '#393b79',
-    '#aec7e8',
-    '#ff7f0e',
-    '#ffbb78',
-    '#98df8a',
-    '#bcbd22',
-    '#404040',
-    '#ff9896',
-    '#c5b0d5',
-    '#8c564b',
-    '#1f77b4',
-    '#5254a3',
-    '#FFDB58',
-    '#c49c94',
-    '#e377c2',
-    '#7f7f7f',
-    '#2ca02c',
-    '#9467bd',
-    '#dbdb8d',
-    '#17becf',
-    '#637939',
-    '#6b6ecf',
-    '#9c9ede',
-    '#d62728',
-    '#8ca252',
-    '#8c6d31',
-    '#bd9e39',
-    '#e7cb94',
-    '#843c39',
-    '#ad494a',
-    '#d6616b',
-    '#7b4173',
-    '#a55194',
-    '#ce6dbd',
-    '#de9ed6'
-  ]
-
-  return [1, 2, 3].map(i => {
-    const dict = {}
-    const s = new Set(dlines.map(l => l[i]))
-    // random way to get color, ignore this
-    Array.from(s).forEach((n, idx) => {
-      dict[n] = all_colors[(idx + 1) * i]
-      if (!dict[n]) {
-        dict[n] = all_colors[4 + idx]
-      }
-    })
-    return dict
-  })
-}
-
-function migrateCluster(data) {
-  const tl = data[0]
-  const dlines = data.slice(1)
-  // unpack the matrix
-
-  const catColors = getClusterColors(dlines)
-  const cat_colors = {
-    col: {},
-    row: {
-      ['cat-0']: catColors[0],
-      ['cat-1']: catColors[1],
-      ['cat-2']: catColors[2]
-    }
-  }
-
-  const col_nodes = tl.map((i, idx) => {
-    return {
-      clust: tl.length - idx,
-      col_index: idx,
-      ini: tl.length,
-      name: i,
-      rank: 0,
-      rankvar: 0
-    }
-  })
-
-  const mat = dlines.map(l => l.slice(4))
-
-  const row_nodes = dlines.map((l, idx) => {
-    return {
-      name: l[0],
-      ['cat-0']: l[1],
-      ['cat-1']: l[2],
-      ['cat-2']: l[3],
-      clust: dlines.length - idx,
-      ini: dlines.length - idx
-    }
-  })
-
-  return { cat_colors, col_nodes, links: [], mat, row_nodes, views: [] }
-}
-
 function buildHeatmap(json) {
   console.log(json)
 
@@ -169,25 +31,18 @@ function buildHeatmap(json) {
     // 'ini_view':{'N_row_var':20}
     ini_expand: true,
     make_row_tooltip_handler: d => {
-      const x = rawInfo[0]['buckets'][d.rank]
-      return `from ${x['start']} to ${x['end']}`
+      const x = allRanges.find(n => n.name === d.name)
+      return x ? `from ${x['start'].desc} to ${x['end'].desc}` : ''
     },
     make_col_tooltip_handler: d => {
-      return ''
-      return rawInfo[d.rank].time
+      return d.name
     },
     matrix_tip_str_handler: (d, inst_value) => {
-      // const len = rawInfo.heatmaps[0].values.length
-      // const hidx = Math.floor(d.pos_y / len)
-      // const valIdx = d.pos_y % len
-      // const x = rawInfo.heatmaps[hidx].ranges[valIdx]
       const x = allRanges[d.pos_y]
-
-      // const x = rawInfo[0]['buckets'][d.pos_y]
       const row_name = `key range from ${JSON.stringify(
         x['start']
       )} to ${JSON.stringify(x['end'])}`
-      const col_name = '' // rawInfo[d.pos_x].time
+      const col_name = json.col_nodes[d.pos_x].name
       tooltip_string =
         '<p>' +
         row_name +
@@ -200,10 +55,7 @@ function buildHeatmap(json) {
       return tooltip_string
     }
   }
-  allRanges = []
-  rawInfo.heatmaps.forEach(h => {
-    allRanges = [...allRanges, ...h.ranges]
-  })
+  allRanges = json.row_nodes
 
   resize_container(args)
 
@@ -226,10 +78,7 @@ function buildHeatmap(json) {
 function make_clust(type) {
   $.busyLoadFull('show')
 
-  getData(type).then(data => {
-    const json = migrateCluster(data)
-    return buildHeatmap(json)
-  })
+  getData(type).then(buildHeatmap)
 
   // d3.json('json/' + inst_network, function(network_data) {
   //   // define arguments object
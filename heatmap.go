@@ -1,23 +1,33 @@
 package main
 
 import (
-	"encoding/hex"
+	"container/heap"
 	"fmt"
 	"sort"
-
-	"github.com/pingcap/tidb/kv"
-	"github.com/pingcap/tidb/tablecodec"
-	"github.com/pingcap/tidb/util/codec"
+	"time"
 )
 
 type Key struct {
-	Desc        string   `json:"desc"`
-	Ts          uint64   `json:"ts,omitempty"`
-	TableID     int64    `json:"table_id,omitempty"`
-	RowID       int64    `json:"row_id,omitempty"`
+	Desc string `json:"desc"`
+	// Kind is "record", "index", "table" for the prefix of a table, "meta",
+	// "raw" for the keys not written by TiDB, or "unknown" if the key can
+	// not be decoded, and Error tells why.
+	Kind  string `json:"kind"`
+	Error string `json:"error,omitempty"`
+	// Raw is the escaped bytes of the raw, meta or undecodable key.
+	Raw     string `json:"raw,omitempty"`
+	Ts      uint64 `json:"ts,omitempty"`
+	TableID int64  `json:"table_id,omitempty"`
+	RowID   int64  `json:"row_id,omitempty"`
+	// HandleType of the record key is "int" for the int64 handle in RowID,
+	// or "common" for the values of the clustered primary key in Row.
+	HandleType  string   `json:"handle_type,omitempty"`
 	RowValue    int64    `json:"row_value,omitempty"`
 	IndexID     int64    `json:"index_id,omitempty"`
 	IndexValues []string `json:"index_values,omitempty"`
+	// Row is the handle or the index values typed by the columns, like
+	// (user_id=42, created_at=2026-01-01), empty if the table is unknown.
+	Row string `json:"row,omitempty"`
 }
 
 // RangeBuilder builds the Range,
@@ -26,49 +36,16 @@ type RangeBuilder struct {
 	End   string
 }
 
-func (s RangeBuilder) Build() Range {
+// Build builds the Range with the keys decoded by the tables live in
+// [startTime, endTime].
+func (s RangeBuilder) Build(startTime time.Time, endTime time.Time) Range {
 	r := Range{
-		StartKey: decodeKey(s.Start),
-		EndKey:   decodeKey(s.End),
+		StartKey: decodeKey(s.Start, startTime, endTime),
+		EndKey:   decodeKey(s.End, startTime, endTime),
 	}
 	return r
 }
 
-func decodeKey(key string) Key {
-	var ts uint64
-	v, err := hex.DecodeString(key)
-
-	if err != nil {
-		panic(err)
-	}
-	tsString, decode, _ := codec.DecodeBytes(v, nil)
-	if len(tsString) == 8 {
-		_, ts, _ = codec.DecodeUintDesc(tsString)
-	}
-	if len(decode) > 0 && decode[0] == 'z' {
-		decode = decode[1:]
-	}
-	desc := string(decode)
-	tableID, indexID, isRecord, _ := tablecodec.DecodeKeyHead(kv.Key(desc))
-	var (
-		rowID       int64
-		indexValues []string
-	)
-	if isRecord {
-		_, rowID, _ = tablecodec.DecodeRecordKey(kv.Key(desc))
-	} else {
-		_, _, indexValues, _ = tablecodec.DecodeIndexKey(kv.Key(desc))
-	}
-	return Key{
-		Desc:        key,
-		Ts:          ts,
-		TableID:     tableID,
-		RowID:       rowID,
-		IndexID:     indexID,
-		IndexValues: indexValues,
-	}
-}
-
 // Range is the range of the bucket
 type Range struct {
 	StartKey Key `json:"start"`
@@ -85,11 +62,28 @@ type Heatmap struct {
 	Labels []string   `json:"labels"`
 	Ranges []Range    `json:"ranges"`
 	Values [][]uint64 `json:"values"`
+	// RangeLabels are the tables and indices every range covers in the
+	// whole key space heatmap.
+	RangeLabels [][]string `json:"range_labels,omitempty"`
+	// Metrics are the values of every metric in the same buckets when
+	// multiple metrics are requested, Values is of the first one.
+	Metrics map[string][][]uint64 `json:"metrics,omitempty"`
+
+	// counters are the values of the counters the metrics derive from, to
+	// derive the metrics again after the columns are merged.
+	counters map[string][][]uint64
+	// moveRegions moves the regions of a new stat into the key space of the
+	// heatmap if it is rolled up across the partitions.
+	moveRegions func(regions []*regionInfo) []*regionInfo
+	// splits are the start keys of the ranges the buckets are squashed
+	// from, to split the regions of a new stat in the same way.
+	splits []string
 }
 
-func calValues(ranges []RangeBuilder, values [][]uint64, regionsVec [][]*regionInfo, index int, getValue func(r *regionInfo) uint64) {
+// coverRanges calls f with every region and the ranges [start, end) it covers,
+// the ranges must be split by the start keys of all the regions.
+func coverRanges(ranges []RangeBuilder, regions []*regionInfo, f func(region *regionInfo, start int, end int)) {
 	startIndex := 0
-	regions := regionsVec[index]
 	for i := 0; i < len(regions); i++ {
 		region := regions[i]
 		startKey := region.StartKey
@@ -107,22 +101,39 @@ func calValues(ranges []RangeBuilder, values [][]uint64, regionsVec [][]*regionI
 			}
 		}
 
-		count := nextIndex - startIndex
-		value := getValue(region) / uint64(count)
+		f(region, startIndex, nextIndex)
+
+		startIndex = nextIndex
+	}
+}
+
+func calValues(ranges []RangeBuilder, values [][]uint64, regionsVec [][]*regionInfo, index int, getValue func(r *regionInfo) uint64) {
+	coverRanges(ranges, regionsVec[index], func(region *regionInfo, start int, end int) {
+		value := getValue(region) / uint64(end-start)
 
-		for j := startIndex; j < nextIndex; j++ {
+		for j := start; j < end; j++ {
 			values[j][index] += value
 		}
+	})
+}
 
-		startIndex = nextIndex
-	}
+// squashFunc squashes the ranges and their values into at most maxBuckets buckets.
+type squashFunc func(ranges []RangeBuilder, values [][]uint64, maxBuckets int) ([]RangeBuilder, [][]uint64)
+
+var squashFuncs = map[string]squashFunc{
+	"step":     squashRanges,
+	"variance": squashRangesByVariance,
 }
 
+// squashRanges merges every step adjacent ranges into one bucket.
 func squashRanges(ranges []RangeBuilder, values [][]uint64, maxBuckets int) ([]RangeBuilder, [][]uint64) {
 	n := len(ranges)
 	if n > maxBuckets {
 		n = maxBuckets
 	}
+	if n == 0 {
+		return ranges, values
+	}
 
 	newRanges := make([]RangeBuilder, n)
 	newValues := make([][]uint64, n)
@@ -144,14 +155,152 @@ func squashRanges(ranges []RangeBuilder, values [][]uint64, maxBuckets int) ([]R
 	return newRanges, newValues
 }
 
+// mergeCandidate is a pair of adjacent buckets to be merged.
+type mergeCandidate struct {
+	cost  float64
+	width int
+	left  int
+	right int
+	// the versions of the buckets when the candidate is made, the candidate
+	// is stale if any of the buckets is merged later.
+	leftVersion  int
+	rightVersion int
+}
+
+type mergeHeap []mergeCandidate
+
+func (h mergeHeap) Len() int      { return len(h) }
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].cost != h[j].cost {
+		return h[i].cost < h[j].cost
+	}
+	// prefer the narrower buckets to keep the cold ranges balanced
+	if h[i].width != h[j].width {
+		return h[i].width < h[j].width
+	}
+	return h[i].left < h[j].left
+}
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(mergeCandidate)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// squashRangesByVariance greedily merges the adjacent buckets whose merging
+// loses the least variance of the values, known as the Ward's method, so the
+// hot ranges are not averaged into the cold neighbours.
+func squashRangesByVariance(ranges []RangeBuilder, values [][]uint64, maxBuckets int) ([]RangeBuilder, [][]uint64) {
+	n := len(ranges)
+	if n <= maxBuckets || maxBuckets <= 0 {
+		return ranges, values
+	}
+
+	type bucket struct {
+		r       RangeBuilder
+		values  []uint64
+		width   int
+		prev    int
+		next    int
+		version int
+		removed bool
+	}
+
+	buckets := make([]bucket, n)
+	for i := 0; i < n; i++ {
+		buckets[i] = bucket{
+			r:      ranges[i],
+			values: values[i],
+			width:  1,
+			prev:   i - 1,
+			next:   i + 1,
+		}
+	}
+
+	// the variance lost by merging is w1*w2/(w1+w2) * |mean1 - mean2|^2
+	candidate := func(left, right int) mergeCandidate {
+		l, r := &buckets[left], &buckets[right]
+		var dist float64
+		for k := 0; k < len(l.values); k++ {
+			d := float64(l.values[k])/float64(l.width) - float64(r.values[k])/float64(r.width)
+			dist += d * d
+		}
+		width := l.width + r.width
+		return mergeCandidate{
+			cost:         float64(l.width*r.width) / float64(width) * dist,
+			width:        width,
+			left:         left,
+			right:        right,
+			leftVersion:  l.version,
+			rightVersion: r.version,
+		}
+	}
+
+	h := make(mergeHeap, 0, n)
+	for i := 0; i < n-1; i++ {
+		h = append(h, candidate(i, i+1))
+	}
+	heap.Init(&h)
+
+	for count := n; count > maxBuckets; {
+		c := heap.Pop(&h).(mergeCandidate)
+		l, r := &buckets[c.left], &buckets[c.right]
+		if l.removed || r.removed || l.version != c.leftVersion || r.version != c.rightVersion {
+			continue
+		}
+
+		l.r.End = r.r.End
+		for k := 0; k < len(l.values); k++ {
+			l.values[k] += r.values[k]
+		}
+		l.width += r.width
+		l.version++
+		l.next = r.next
+		if r.next < n {
+			buckets[r.next].prev = c.left
+		}
+		r.removed = true
+		count--
+
+		if l.prev >= 0 {
+			heap.Push(&h, candidate(l.prev, c.left))
+		}
+		if l.next < n {
+			heap.Push(&h, candidate(c.left, l.next))
+		}
+	}
+
+	newRanges := make([]RangeBuilder, 0, maxBuckets)
+	newValues := make([][]uint64, 0, maxBuckets)
+	for i := 0; i < n; i = buckets[i].next {
+		newRanges = append(newRanges, buckets[i].r)
+		newValues = append(newValues, buckets[i].values)
+	}
+
+	return newRanges, newValues
+}
+
 func buildRanges(regions [][]*regionInfo) []RangeBuilder {
 	keySet := make(map[string]struct{}, len(regions[0]))
-	// use all the regions' start key to split the whole range
+	// use all the regions' start key to split the whole range,
+	// snapshots of the gaps have no regions and are skipped.
+	var endKey string
+	hasEnd := false
 	for i := 0; i < len(regions); i++ {
 		for j := 0; j < len(regions[i]); j++ {
 			region := regions[i][j]
 			keySet[region.StartKey] = struct{}{}
 		}
+		if !hasEnd && len(regions[i]) > 0 {
+			endKey = regions[i][len(regions[i])-1].EndKey
+			hasEnd = true
+		}
+	}
+	if len(keySet) == 0 {
+		return nil
 	}
 
 	keys := make([]string, 0, len(keySet))
@@ -171,30 +320,179 @@ func buildRanges(regions [][]*regionInfo) []RangeBuilder {
 
 	ranges[len(keys)-1] = RangeBuilder{
 		Start: keys[len(keys)-1],
-		End:   regions[0][len(regions[0])-1].EndKey,
+		End:   endKey,
 	}
 	return ranges
 }
 
-func newHeatmap(regions [][]*regionInfo, maxBuckets int, getValue func(r *regionInfo) uint64) Heatmap {
-	rs := buildRanges(regions)
+// regroupValues sums the values of the ranges into the buckets squashed from them.
+func regroupValues(ranges []RangeBuilder, values [][]uint64, buckets []RangeBuilder) [][]uint64 {
+	newValues := make([][]uint64, len(buckets))
+	j := 0
+	for i, b := range buckets {
+		newValues[i] = make([]uint64, len(values[j]))
+		for ; j < len(ranges); j++ {
+			for k, v := range values[j] {
+				newValues[i][k] += v
+			}
+			if ranges[j].End == b.End {
+				j++
+				break
+			}
+		}
+	}
+	return newValues
+}
 
-	values := make([][]uint64, len(rs))
-	for i := 0; i < len(values); i++ {
-		values[i] = make([]uint64, len(regions))
+// calCounterValues calculates the values of the ranges for every counter
+// used by the metrics.
+func calCounterValues(ranges []RangeBuilder, regions [][]*regionInfo, metrics []*metric) map[string][][]uint64 {
+	counterValues := make(map[string][][]uint64)
+	for _, m := range metrics {
+		for _, name := range m.counters {
+			if _, ok := counterValues[name]; ok {
+				continue
+			}
+
+			values := make([][]uint64, len(ranges))
+			for i := 0; i < len(values); i++ {
+				values[i] = make([]uint64, len(regions))
+			}
+			for i := 0; i < len(regions); i++ {
+				calValues(ranges, values, regions, i, counters[name])
+			}
+			counterValues[name] = values
+		}
 	}
+	return counterValues
+}
 
-	for i := 0; i < len(regions); i++ {
-		calValues(rs, values, regions, i, getValue)
+// newHeatmap builds the heatmap of the metrics in [startTime, endTime], the
+// buckets are squashed by the first metric and shared by the others.
+func newHeatmap(regions [][]*regionInfo, startTime time.Time, endTime time.Time, maxBuckets int, squash squashFunc, metrics []*metric) Heatmap {
+	rs := buildRanges(regions)
+	counterValues := calCounterValues(rs, regions, metrics)
+
+	builders, _ := squash(rs, metrics[0].deriveValues(counterValues), maxBuckets)
+	for name, values := range counterValues {
+		counterValues[name] = regroupValues(rs, values, builders)
 	}
-	builders, values := squashRanges(rs, values, maxBuckets)
 
 	ranges := make([]Range, len(builders))
 	for i, b := range builders {
-		ranges[i] = b.Build()
+		ranges[i] = b.Build(startTime, endTime)
 	}
-	return Heatmap{
-		Ranges: ranges,
-		Values: values,
+	splits := make([]string, len(rs))
+	for i, r := range rs {
+		splits[i] = r.Start
 	}
+	h := Heatmap{
+		Ranges:   ranges,
+		Values:   metrics[0].deriveValues(counterValues),
+		counters: counterValues,
+		splits:   splits,
+	}
+	if len(metrics) > 1 {
+		h.Metrics = make(map[string][][]uint64, len(metrics))
+		for _, m := range metrics {
+			h.Metrics[m.name] = m.deriveValues(counterValues)
+		}
+	}
+	return h
+}
+
+// aggFunc aggregates the values of the merged columns.
+type aggFunc func(values []uint64) uint64
+
+var aggFuncs = map[string]aggFunc{
+	"sum": func(values []uint64) uint64 {
+		var sum uint64
+		for _, v := range values {
+			sum += v
+		}
+		return sum
+	},
+	"avg": func(values []uint64) uint64 {
+		var sum uint64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / uint64(len(values))
+	},
+	"max": func(values []uint64) uint64 {
+		var max uint64
+		for _, v := range values {
+			if v > max {
+				max = v
+			}
+		}
+		return max
+	},
+}
+
+// compressColumns merges every step adjacent columns of the values into one
+// by agg, the gap columns are left out of the aggregation.
+func compressColumns(values [][]uint64, isGap []bool, step int, agg aggFunc) [][]uint64 {
+	columns := len(isGap)
+	n := (columns + step - 1) / step
+
+	newValues := make([][]uint64, len(values))
+	buf := make([]uint64, 0, step)
+	for i, row := range values {
+		newValues[i] = make([]uint64, n)
+		for j := 0; j < n; j++ {
+			buf = buf[:0]
+			for k := j * step; k < (j+1)*step && k < columns; k++ {
+				if !isGap[k] {
+					buf = append(buf, row[k])
+				}
+			}
+			if len(buf) > 0 {
+				newValues[i][j] = agg(buf)
+			}
+		}
+	}
+
+	return newValues
+}
+
+// compressColumns merges every step adjacent columns of the heatmap by agg.
+// The counters are merged and the metrics derived from them again, as a
+// ratio like bytes_per_key can not be summed.
+func (h *Heatmap) compressColumns(isGap []bool, step int, agg aggFunc, metrics []*metric) {
+	if h.counters == nil {
+		h.Values = compressColumns(h.Values, isGap, step, agg)
+		for name, values := range h.Metrics {
+			h.Metrics[name] = compressColumns(values, isGap, step, agg)
+		}
+		return
+	}
+
+	for name, values := range h.counters {
+		h.counters[name] = compressColumns(values, isGap, step, agg)
+	}
+	h.Values = metrics[0].deriveValues(h.counters)
+	if h.Metrics != nil {
+		for _, m := range metrics {
+			h.Metrics[m.name] = m.deriveValues(h.counters)
+		}
+	}
+}
+
+// compressTimes merges every step adjacent columns into one starting at the
+// first one, which is a gap only if all the merged columns are gaps.
+func compressTimes(times []time.Time, isGap []bool, step int) ([]time.Time, []bool) {
+	n := (len(times) + step - 1) / step
+
+	newTimes := make([]time.Time, n)
+	newGaps := make([]bool, n)
+	for j := 0; j < n; j++ {
+		newTimes[j] = times[j*step]
+		newGaps[j] = true
+		for k := j * step; k < (j+1)*step && k < len(times); k++ {
+			newGaps[j] = newGaps[j] && isGap[k]
+		}
+	}
+
+	return newTimes, newGaps
 }
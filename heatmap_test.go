@@ -7,6 +7,7 @@ import (
 	"github.com/pingcap/tidb/util/codec"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func newRegionInfo(start string, end string, value uint64) *regionInfo {
@@ -22,6 +23,8 @@ func getWrittenBtes(r *regionInfo) uint64 {
 	return r.WrittenBytes
 }
 
+var writtenBytes = []*metric{{name: "written_bytes", counters: []string{"written_bytes"}, derive: sumValues}}
+
 func encodeTablePrefix(tableID int64) string {
 	key := tablecodec.EncodeTablePrefix(tableID)
 	raw := codec.EncodeBytes([]byte(nil), key)
@@ -57,14 +60,14 @@ func TestBuildRange(t *testing.T) {
 	builders := buildRanges(regions)
 	ranges := make([]Range, len(builders))
 	for i, b := range builders {
-		ranges[i] = b.Build()
+		ranges[i] = b.Build(time.Now(), time.Now())
 	}
 
 	expectd := []Range{
-		{Key{Desc: "7480000000000000ff0100000000000000f8", TableID: 1}, Key{Desc: "7480000000000000ff0200000000000000f8", TableID: 2}},
-		{Key{Desc: "7480000000000000ff0200000000000000f8", TableID: 2}, Key{Desc: "7480000000000000ff0300000000000000f8", TableID: 3}},
-		{Key{Desc: "7480000000000000ff0300000000000000f8", TableID: 3}, Key{Desc: "7480000000000000ff035f698000000000ff0000010000000000fa", TableID: 3, IndexID: 1}},
-		{Key{Desc: "7480000000000000ff035f698000000000ff0000010000000000fa", TableID: 3, IndexID: 1}, Key{Desc: "7480000000000000ff0400000000000000f8", TableID: 4}},
+		{Key{Desc: "7480000000000000ff0100000000000000f8", Kind: "table", TableID: 1}, Key{Desc: "7480000000000000ff0200000000000000f8", Kind: "table", TableID: 2}},
+		{Key{Desc: "7480000000000000ff0200000000000000f8", Kind: "table", TableID: 2}, Key{Desc: "7480000000000000ff0300000000000000f8", Kind: "table", TableID: 3}},
+		{Key{Desc: "7480000000000000ff0300000000000000f8", Kind: "table", TableID: 3}, Key{Desc: "7480000000000000ff035f698000000000ff0000010000000000fa", Kind: "index", TableID: 3, IndexID: 1}},
+		{Key{Desc: "7480000000000000ff035f698000000000ff0000010000000000fa", Kind: "index", TableID: 3, IndexID: 1}, Key{Desc: "7480000000000000ff0400000000000000f8", Kind: "table", TableID: 4}},
 	}
 
 	if !reflect.DeepEqual(ranges, expectd) {
@@ -167,14 +170,130 @@ func TestHeatmap(t *testing.T) {
 		},
 	}
 
-	h := newHeatmap(regions, 2, getWrittenBtes)
+	h := newHeatmap(regions, time.Now(), time.Now(), 2, squashRanges, writtenBytes)
 
 	expectedRanges := []Range{
-		{Key{Desc: "7480000000000000ff0100000000000000f8", TableID: 1}, Key{Desc: "7480000000000000ff0300000000000000f8", TableID: 3}},
-		{Key{Desc: "7480000000000000ff0300000000000000f8", TableID: 3}, Key{Desc: "7480000000000000ff0400000000000000f8", TableID: 4}},
+		{Key{Desc: "7480000000000000ff0100000000000000f8", Kind: "table", TableID: 1}, Key{Desc: "7480000000000000ff0300000000000000f8", Kind: "table", TableID: 3}},
+		{Key{Desc: "7480000000000000ff0300000000000000f8", Kind: "table", TableID: 3}, Key{Desc: "7480000000000000ff0400000000000000f8", Kind: "table", TableID: 4}},
 	}
 
 	if !reflect.DeepEqual(expectedRanges, h.Ranges) {
 		t.Fatalf("want %v, but got %v", expectedRanges, h.Ranges)
 	}
 }
+
+func TestHeatmapWithGap(t *testing.T) {
+	regions := [][]*regionInfo{
+		nil,
+		{
+			newRegionInfo(encodeTablePrefix(1), encodeTablePrefix(2), 10),
+			newRegionInfo(encodeTablePrefix(2), encodeTablePrefix(3), 20),
+		},
+	}
+
+	h := newHeatmap(regions, time.Now(), time.Now(), 2, squashRanges, writtenBytes)
+
+	expectedValues := [][]uint64{
+		{0, 10},
+		{0, 20},
+	}
+	if !reflect.DeepEqual(expectedValues, h.Values) {
+		t.Fatalf("want %v, but got %v", expectedValues, h.Values)
+	}
+
+	h = newHeatmap([][]*regionInfo{nil, nil}, time.Now(), time.Now(), 2, squashRanges, writtenBytes)
+	if len(h.Ranges) != 0 || len(h.Values) != 0 {
+		t.Fatalf("expect empty heatmap, but got %v", h)
+	}
+}
+
+func TestSquashRangesByVariance(t *testing.T) {
+	ranges := []RangeBuilder{
+		{"", "a"},
+		{"a", "b"},
+		{"b", "c"},
+		{"c", "d"},
+		{"d", "e"},
+		{"e", "f"},
+		{"f", ""},
+	}
+
+	values := [][]uint64{
+		{1, 1},
+		{1, 2},
+		{100, 90},
+		{2, 1},
+		{1, 1},
+		{1, 1},
+		{50, 50},
+	}
+
+	newRanges, newValues := squashRangesByVariance(ranges, values, 4)
+
+	// the hot ranges are kept and the cold ones are merged
+	expectedRanges := []RangeBuilder{
+		{"", "b"},
+		{"b", "c"},
+		{"c", "f"},
+		{"f", ""},
+	}
+	if !reflect.DeepEqual(newRanges, expectedRanges) {
+		t.Fatalf("want %v, but got %v", expectedRanges, newRanges)
+	}
+
+	expectedValues := [][]uint64{
+		{2, 3},
+		{100, 90},
+		{4, 3},
+		{50, 50},
+	}
+	if !reflect.DeepEqual(newValues, expectedValues) {
+		t.Fatalf("want %v, but got %v", expectedValues, newValues)
+	}
+
+	// the cold ranges are merged evenly
+	ranges = []RangeBuilder{{"", "a"}, {"a", "b"}, {"b", "c"}, {"c", ""}}
+	values = [][]uint64{{0}, {0}, {0}, {0}}
+	newRanges, _ = squashRangesByVariance(ranges, values, 2)
+	expectedRanges = []RangeBuilder{{"", "b"}, {"b", ""}}
+	if !reflect.DeepEqual(newRanges, expectedRanges) {
+		t.Fatalf("want %v, but got %v", expectedRanges, newRanges)
+	}
+}
+
+func TestCompressColumns(t *testing.T) {
+	values := [][]uint64{
+		{1, 2, 3, 4, 5},
+		{6, 0, 8, 9, 10},
+	}
+	isGap := []bool{false, true, false, false, false}
+
+	check := func(agg string, expected [][]uint64) {
+		newValues := compressColumns(values, isGap, 2, aggFuncs[agg])
+		if !reflect.DeepEqual(newValues, expected) {
+			t.Fatalf("want %v, but got %v for %s", expected, newValues, agg)
+		}
+	}
+
+	// the gap column is left out
+	check("sum", [][]uint64{{1, 7, 5}, {6, 17, 10}})
+	check("avg", [][]uint64{{1, 3, 5}, {6, 8, 10}})
+	check("max", [][]uint64{{1, 4, 5}, {6, 9, 10}})
+
+	base := time.Unix(1571400000, 0)
+	times := make([]time.Time, 5)
+	for i := range times {
+		times[i] = base.Add(time.Duration(i) * time.Minute)
+	}
+	isGap = []bool{true, true, false, true, true}
+	newTimes, newGaps := compressTimes(times, isGap, 2)
+
+	expectedTimes := []time.Time{base, base.Add(2 * time.Minute), base.Add(4 * time.Minute)}
+	if !reflect.DeepEqual(newTimes, expectedTimes) {
+		t.Fatalf("want %v, but got %v", expectedTimes, newTimes)
+	}
+	expectedGaps := []bool{true, false, true}
+	if !reflect.DeepEqual(newGaps, expectedGaps) {
+		t.Fatalf("want %v, but got %v", expectedGaps, newGaps)
+	}
+}
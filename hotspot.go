@@ -0,0 +1,112 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Hotspot is a key range with the load in a time window.
+type Hotspot struct {
+	Range
+	// Labels are the tables and indices the range covers.
+	Labels  []string `json:"labels,omitempty"`
+	Peak    uint64   `json:"peak"`
+	Average uint64   `json:"average"`
+	// HotIntervals is the max number of consecutive intervals the range
+	// stays above the threshold.
+	HotIntervals int `json:"hot_intervals"`
+}
+
+// percentile returns the p-th percentile of the values in the columns
+// which are not gaps.
+func percentile(values [][]uint64, isGap []bool, p float64) uint64 {
+	all := make([]uint64, 0, len(values)*len(isGap))
+	for _, row := range values {
+		for j, v := range row {
+			if !isGap[j] {
+				all = append(all, v)
+			}
+		}
+	}
+	if len(all) == 0 {
+		return 0
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	return all[int(float64(len(all)-1)*p)]
+}
+
+// findHotspots ranks the ranges by the average values of the columns which
+// are not gaps, then by how long they stay hot, then by the peak values, and
+// returns the top limit ones.
+func findHotspots(ranges []RangeBuilder, values [][]uint64, isGap []bool, startTime time.Time, endTime time.Time, threshold uint64, limit int) []Hotspot {
+	columns := 0
+	for _, gap := range isGap {
+		if !gap {
+			columns++
+		}
+	}
+	if columns == 0 {
+		return nil
+	}
+
+	type candidate struct {
+		index   int
+		peak    uint64
+		average uint64
+		maxHot  int
+	}
+
+	candidates := make([]candidate, len(ranges))
+	for i, row := range values {
+		c := candidate{index: i}
+		var sum uint64
+		hot := 0
+		for j, v := range row {
+			if isGap[j] {
+				hot = 0
+				continue
+			}
+
+			if v > threshold {
+				hot++
+			} else {
+				hot = 0
+			}
+			if hot > c.maxHot {
+				c.maxHot = hot
+			}
+			if v > c.peak {
+				c.peak = v
+			}
+			sum += v
+		}
+		c.average = sum / uint64(columns)
+		candidates[i] = c
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].average != candidates[j].average {
+			return candidates[i].average > candidates[j].average
+		}
+		if candidates[i].maxHot != candidates[j].maxHot {
+			return candidates[i].maxHot > candidates[j].maxHot
+		}
+		return candidates[i].peak > candidates[j].peak
+	})
+
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	hotspots := make([]Hotspot, 0, len(candidates))
+	for _, c := range candidates {
+		hotspots = append(hotspots, Hotspot{
+			Range:        ranges[c.index].Build(startTime, endTime),
+			Peak:         c.peak,
+			Average:      c.average,
+			HotIntervals: c.maxHot,
+		})
+	}
+	return hotspots
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFindHotspots(t *testing.T) {
+	ranges := []RangeBuilder{
+		{"", encodeTablePrefix(1)},
+		{encodeTablePrefix(1), encodeTablePrefix(2)},
+		{encodeTablePrefix(2), encodeTablePrefix(3)},
+		{encodeTablePrefix(3), ""},
+	}
+	values := [][]uint64{
+		{1, 0, 1, 1, 1},
+		{9, 0, 9, 9, 1},
+		{20, 0, 1, 1, 1},
+		{5, 0, 5, 6, 5},
+	}
+	isGap := []bool{false, true, false, false, false}
+
+	if p := percentile(values, isGap, 0.9); p != 9 {
+		t.Fatalf("want the 90th percentile 9, but got %d", p)
+	}
+
+	hotspots := findHotspots(ranges, values, isGap, time.Now(), time.Now(), 4, 3)
+
+	expected := []struct {
+		tableID      int64
+		peak         uint64
+		average      uint64
+		hotIntervals int
+	}{
+		{1, 9, 7, 2},
+		{3, 6, 5, 3},
+		{2, 20, 5, 1},
+	}
+	if len(hotspots) != len(expected) {
+		t.Fatalf("want %d hotspots, but got %d", len(expected), len(hotspots))
+	}
+	for i, e := range expected {
+		h := hotspots[i]
+		if h.StartKey.TableID != e.tableID || h.Peak != e.peak || h.Average != e.average || h.HotIntervals != e.hotIntervals {
+			t.Fatalf("want %v, but got table %d %d %d %d at %d", e, h.StartKey.TableID, h.Peak, h.Average, h.HotIntervals, i)
+		}
+	}
+
+	if hotspots = findHotspots(ranges, values, []bool{true, true, true, true, true}, time.Now(), time.Now(), 0, 3); hotspots != nil {
+		t.Fatalf("expect no hotspot in gaps, but got %v", hotspots)
+	}
+}
@@ -2,14 +2,16 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"runtime/debug"
+	"strings"
 	"time"
 
+	"github.com/pingcap/goleveldb/leveldb"
 	"github.com/rs/cors"
 )
 
@@ -20,6 +22,16 @@ var (
 	interval  = flag.Duration("I", time.Minute, "Interval to collect metrics")
 	ingoreSys = flag.Bool("no-sys", true, "Ignore system database")
 	addr      = flag.String("addr", "0.0.0.0:8000", "Listening address")
+	replayDir = flag.String("replay", "", "Directory of PD region dumps to replay instead of scanning PD")
+	retryNum  = flag.Int("retry", 3, "Max attempts when requesting PD or TiDB")
+	backoff   = flag.Duration("backoff", time.Second, "Initial backoff between the attempts")
+	dataDir   = flag.String("data-dir", "", "Directory to persist the stats, keep them in memory if empty")
+	retention = flag.Duration("retention", 6*time.Hour, "How long to keep the raw stats")
+	squash    = flag.String("squash", "step", "How to squash the ranges into buckets, step or variance")
+	alertPath = flag.String("alert-rules", "", "JSON file of the alert rules and webhooks")
+	rollups   = flag.String("rollups", "10m:168h,1h:720h", "Steps and retentions to roll up the old stats, like step:retention,...")
+	include   = flag.String("include", "", "Comma separated globs or /regexps/ of db.table to show, all if empty")
+	exclude   = flag.String("exclude", "", "Comma separated globs or /regexps/ of db.table to skip")
 )
 
 func perr(err error) {
@@ -32,14 +44,39 @@ func perr(err error) {
 	os.Exit(1)
 }
 
-func updateStat(ctx context.Context) {
+func updateStat(ctx context.Context, source RegionSource) {
 	ticker := time.NewTicker(*interval)
 	defer ticker.Stop()
 
 	for {
-		regions := scanRegions()
-		stat.append(regions)
-		updateTables()
+		var regions []*regionInfo
+		err := retry(ctx, *retryNum, *backoff, func() (err error) {
+			start := time.Now()
+			if regions, err = source.Scan(); err != nil {
+				collector.incPDErrors()
+				return err
+			}
+			collector.observeScan(time.Since(start), len(regions))
+			return nil
+		})
+		s := &Stat{Time: time.Now(), Regions: regions, Interval: *interval}
+		if err != nil {
+			log.Printf("scan regions failed, skip this tick: %v", err)
+			s = &Stat{Time: s.Time, Interval: *interval, Gap: true}
+		}
+		if err = stat.append(s); err != nil {
+			log.Printf("save stat failed: %v", err)
+		}
+		broker.publish(s)
+		if alerter != nil {
+			alerter.enqueue(alerter.check(s, loadTables()))
+		}
+
+		// keep using the loaded tables if TiDB is unavailable
+		if err = retry(ctx, *retryNum, *backoff, updateTables); err != nil {
+			log.Printf("update tables failed: %v", err)
+		}
+
 		select {
 		case <-ticker.C:
 		case <-ctx.Done():
@@ -48,86 +85,64 @@ func updateStat(ctx context.Context) {
 	}
 }
 
-type outStat struct {
-	StartTime time.Time `json:"start"`
-	EndTime   time.Time `json:"end"`
-	Unit      string    `json:"unit"`
-
-	Heatmaps []Heatmap `json:"heatmaps"`
-}
-
-func handler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	// start=-10m&end=-1m&tag=written_bytes
-	start := r.FormValue("start")
-	end := r.FormValue("end")
-	tag := r.FormValue("tag")
-
-	endTime := time.Now()
-	startTime := endTime.Add(-*interval)
-
-	if start != "" {
-		if d, err := time.ParseDuration(start); err == nil {
-			startTime = endTime.Add(d)
-		}
+func main() {
+	flag.Parse()
+	if _, ok := squashFuncs[*squash]; !ok {
+		perr(fmt.Errorf("unknown squash mode %q", *squash))
 	}
-	if end != "" {
-		if d, err := time.ParseDuration(end); err == nil {
-			endTime = endTime.Add(d)
-		}
+	if *retryNum < 1 {
+		perr(fmt.Errorf("retry must be at least 1, but got %d", *retryNum))
 	}
-
-	f := func(r *regionInfo) uint64 {
-		switch tag {
-		case "read_bytes":
-			return r.ReadBytes
-		default:
-			// written_bytes
-			return r.WrittenBytes
-		}
+	excludes := *exclude
+	if *ingoreSys {
+		excludes = strings.Join(append(sysSchemas, excludes), ",")
 	}
-
-	stats := stat.rangeStats(startTime, endTime)
-	if len(stats) == 0 {
-		return
+	f, err := newTableFilter(*include, excludes)
+	perr(err)
+	filters = f
+	if *alertPath != "" {
+		a, err := loadAlerter(*alertPath)
+		perr(err)
+		alerter = a
+		go alerter.run()
 	}
 
-	regions := make([][]*regionInfo, len(stats))
-	for i := 0; i < len(regions); i++ {
-		regions[i] = stats[i].Regions
-	}
+	tiers, err := parseTiers(*interval, *retention, *rollups)
+	perr(err)
 
-	tbls := loadTables()
-	heatmaps := make([]Heatmap, 0, len(tbls))
-	for _, tbl := range tbls {
-		if *ingoreSys {
-			if tbl.DB == "mysql" {
-				continue
-			}
+	var db *leveldb.DB
+	if *dataDir != "" {
+		db, err = leveldb.OpenFile(*dataDir, nil)
+		perr(err)
+	}
+	for _, t := range tiers {
+		if db != nil {
+			t.store = newLevelStatStore(db, t.step.String()+"/", t.retention)
+		} else {
+			t.store = newRingStatStore(int(t.retention/t.step) + 1)
 		}
-		heatmaps = tableHeatmap(heatmaps, tbl, regions, *bucketNum, f)
 	}
-
-	output := outStat{
-		StartTime: stats[0].Time,
-		EndTime:   stats[len(stats)-1].Time,
-		Unit:      interval.String(),
-		Heatmaps:  heatmaps,
+	stat = newTieredStat(tiers)
+	// keep the dropped tables as long as their stats
+	tables.retention = tiers[len(tiers)-1].retention
+
+	var source RegionSource = newPDRegionSource(*pdAddr)
+	if *replayDir != "" {
+		s, err := newFileRegionSource(*replayDir)
+		perr(err)
+		source = s
 	}
 
-	data, _ := json.Marshal(output)
-	w.Write(data)
-}
-
-func main() {
-	flag.Parse()
-	stat.ringStat = newRingStat(1024)
-
-	go updateStat(context.Background())
+	go updateStat(context.Background(), source)
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/heatmaps", handler)
+	mux.HandleFunc("/heatmaps/range", rangeHandler)
+	mux.HandleFunc("/heatmaps/stream", streamHandler)
+	mux.HandleFunc("/heatmaps/image", imageHandler)
+	mux.HandleFunc("/hotspots", hotspotsHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/status", statusHandler)
 
 	// cors.Default() setup the middleware with default options being
 	// all origins accepted with simple methods (GET, POST). See
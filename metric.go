@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// counters are the traffic counters of a region reported by PD.
+var counters = map[string]func(r *regionInfo) uint64{
+	"written_bytes": func(r *regionInfo) uint64 { return r.WrittenBytes },
+	"read_bytes":    func(r *regionInfo) uint64 { return r.ReadBytes },
+	"written_keys":  func(r *regionInfo) uint64 { return r.WrittenKeys },
+	"read_keys":     func(r *regionInfo) uint64 { return r.ReadKeys },
+}
+
+// metric is the value shown in the heatmap. The counters are aggregated
+// into the buckets separately, then derive computes the value of a bucket
+// from them, so the ratios are not broken by splitting and summing.
+type metric struct {
+	name     string
+	counters []string
+	derive   func(values []uint64) uint64
+}
+
+func sumValues(values []uint64) uint64 {
+	var sum uint64
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+func ratio(a uint64, b uint64) uint64 {
+	if b == 0 {
+		return 0
+	}
+	return a / b
+}
+
+var derivedMetrics = map[string]*metric{
+	"bytes_per_key": {
+		counters: []string{"read_bytes", "written_bytes", "read_keys", "written_keys"},
+		derive: func(v []uint64) uint64 {
+			return ratio(v[0]+v[1], v[2]+v[3])
+		},
+	},
+	// in percent
+	"read_write_ratio": {
+		counters: []string{"read_bytes", "written_bytes"},
+		derive: func(v []uint64) uint64 {
+			return ratio(v[0]*100, v[1])
+		},
+	},
+}
+
+// parseMetric parses the tag, which is a counter, a sum of counters like
+// read_bytes+written_bytes, or a derived metric.
+func parseMetric(tag string) (*metric, error) {
+	if m, ok := derivedMetrics[tag]; ok {
+		return &metric{name: tag, counters: m.counters, derive: m.derive}, nil
+	}
+
+	names := strings.Split(tag, "+")
+	for _, name := range names {
+		if _, ok := counters[name]; !ok {
+			return nil, fmt.Errorf("unknown tag %q", tag)
+		}
+	}
+	return &metric{name: tag, counters: names, derive: sumValues}, nil
+}
+
+// parseMetrics parses the comma separated tags.
+func parseMetrics(tags string) ([]*metric, error) {
+	var metrics []*metric
+	for _, tag := range strings.Split(tags, ",") {
+		m, err := parseMetric(strings.TrimSpace(tag))
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, nil
+}
+
+// deriveValues computes the values of the metric from the matrices of its
+// counters.
+func (m *metric) deriveValues(counterValues map[string][][]uint64) [][]uint64 {
+	first := counterValues[m.counters[0]]
+	values := make([][]uint64, len(first))
+	buf := make([]uint64, len(m.counters))
+	for i := range values {
+		values[i] = make([]uint64, len(first[i]))
+		for j := range values[i] {
+			for k, name := range m.counters {
+				buf[k] = counterValues[name][i][j]
+			}
+			values[i][j] = m.derive(buf)
+		}
+	}
+	return values
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseMetrics(t *testing.T) {
+	metrics, err := parseMetrics("read_keys, read_bytes+written_bytes,bytes_per_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		{"read_keys"},
+		{"read_bytes", "written_bytes"},
+		{"read_bytes", "written_bytes", "read_keys", "written_keys"},
+	}
+	for i, m := range metrics {
+		if !reflect.DeepEqual(m.counters, expected[i]) {
+			t.Fatalf("want %v, but got %v for %s", expected[i], m.counters, m.name)
+		}
+	}
+
+	for _, tags := range []string{"", "foo", "read_bytes+", "read_bytes,bytes_per_key+read_keys"} {
+		if _, err = parseMetrics(tags); err == nil {
+			t.Fatalf("expect error for %q", tags)
+		}
+	}
+}
+
+func TestHeatmapMetrics(t *testing.T) {
+	regions := [][]*regionInfo{
+		{
+			{StartKey: "", EndKey: "61", WrittenBytes: 100, WrittenKeys: 10, ReadBytes: 50},
+			{StartKey: "61", EndKey: "", WrittenBytes: 10, WrittenKeys: 10, ReadBytes: 10, ReadKeys: 10},
+		},
+		{
+			{StartKey: "", EndKey: "", WrittenBytes: 20, WrittenKeys: 2, ReadBytes: 40, ReadKeys: 2},
+		},
+	}
+
+	metrics, err := parseMetrics("written_bytes,read_bytes+written_bytes,bytes_per_key,read_write_ratio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHeatmap(regions, time.Now(), time.Now(), 2, squashRanges, metrics)
+
+	expected := map[string][][]uint64{
+		"written_bytes":            {{100, 10}, {10, 10}},
+		"read_bytes+written_bytes": {{150, 30}, {20, 30}},
+		// the ratios are derived from the counters of the bucket
+		"bytes_per_key":    {{15, 15}, {1, 15}},
+		"read_write_ratio": {{50, 200}, {100, 200}},
+	}
+	if !reflect.DeepEqual(h.Metrics, expected) {
+		t.Fatalf("want %v, but got %v", expected, h.Metrics)
+	}
+	if !reflect.DeepEqual(h.Values, expected["written_bytes"]) {
+		t.Fatalf("want %v, but got %v", expected["written_bytes"], h.Values)
+	}
+
+	// the buckets are shared by all the metrics
+	h = newHeatmap(regions, time.Now(), time.Now(), 1, squashRanges, metrics)
+	if len(h.Ranges) != 1 || h.Metrics["bytes_per_key"][0][0] != 5 {
+		t.Fatalf("unexpected heatmap %v", h)
+	}
+}
+
+func TestCompressDerivedMetrics(t *testing.T) {
+	old := stat
+	defer func() { stat = old }()
+	s := newRingStatStore(10)
+	stat = s
+
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		s.append(&Stat{
+			Time:    now.Add(time.Duration(i-2) * *interval),
+			Regions: []*regionInfo{{StartKey: "", EndKey: "", WrittenBytes: 20, WrittenKeys: 10}},
+		})
+	}
+
+	w := httptest.NewRecorder()
+	// start from the first stat to not pad the gaps before it
+	start, step := (5 * *interval / 2).String(), (2 * *interval).String()
+	handler(w, httptest.NewRequest("GET", "/heatmaps?scope=cluster&start=-"+start+"&tag=bytes_per_key,written_bytes&step="+step, nil))
+	var out outStat
+	if err := json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Times) != 1 || len(out.Heatmaps) != 1 {
+		t.Fatalf("unexpected output %v", out)
+	}
+
+	// the ratio is derived from the merged counters instead of summed
+	h := out.Heatmaps[0]
+	if h.Values[0][0] != 2 || h.Metrics["bytes_per_key"][0][0] != 2 || h.Metrics["written_bytes"][0][0] != 40 {
+		t.Fatalf("unexpected heatmap %v", h)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// collectorStats are the metrics of the collector itself.
+type collectorStats struct {
+	sync.Mutex
+
+	scanDuration time.Duration
+	regionCount  int
+	pdErrors     uint64
+}
+
+func (c *collectorStats) observeScan(d time.Duration, regions int) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.scanDuration = d
+	c.regionCount = regions
+}
+
+func (c *collectorStats) incPDErrors() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.pdErrors++
+}
+
+var collector collectorStats
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promWriter writes the metrics in the Prometheus text format.
+type promWriter struct {
+	bytes.Buffer
+}
+
+func (p *promWriter) header(name string, typ string, help string) {
+	fmt.Fprintf(p, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample with the labels in pairs of name and value.
+func (p *promWriter) sample(name string, value float64, labels ...string) {
+	p.WriteString(name)
+	if len(labels) > 0 {
+		p.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				p.WriteByte(',')
+			}
+			fmt.Fprintf(p, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		p.WriteByte('}')
+	}
+	fmt.Fprintf(p, " %v\n", value)
+}
+
+func (p *promWriter) writeCollector() {
+	collector.Lock()
+	scanDuration, regionCount, pdErrors := collector.scanDuration, collector.regionCount, collector.pdErrors
+	collector.Unlock()
+
+	p.header("keyvisual_scan_duration_seconds", "gauge", "Duration of the latest region scan.")
+	p.sample("keyvisual_scan_duration_seconds", scanDuration.Seconds())
+	p.header("keyvisual_region_count", "gauge", "Number of regions in the latest scan.")
+	p.sample("keyvisual_region_count", float64(regionCount))
+	p.header("keyvisual_pd_errors_total", "counter", "Number of failed region scans.")
+	p.sample("keyvisual_pd_errors_total", float64(pdErrors))
+
+	t, ok := stat.(*TieredStat)
+	if !ok {
+		return
+	}
+	var steps []string
+	var lens, caps []int
+	for _, tier := range t.tiers {
+		if r, ok := tier.store.(*RingStat); ok {
+			n, capacity := r.occupancy()
+			steps = append(steps, tier.step.String())
+			lens = append(lens, n)
+			caps = append(caps, capacity)
+		}
+	}
+	if len(steps) == 0 {
+		return
+	}
+
+	p.header("keyvisual_ring_stats", "gauge", "Number of stats in the in-memory ring of every step.")
+	for i, step := range steps {
+		p.sample("keyvisual_ring_stats", float64(lens[i]), "step", step)
+	}
+	p.header("keyvisual_ring_capacity", "gauge", "Max number of stats in the in-memory ring of every step.")
+	for i, step := range steps {
+		p.sample("keyvisual_ring_capacity", float64(caps[i]), "step", step)
+	}
+}
+
+// writeTables writes the counters of every table and index in the stat.
+func (p *promWriter) writeTables(s *Stat, tbls []*Table) {
+	spans := tableSpans(tbls)
+	for _, name := range []string{"written_bytes", "read_bytes", "written_keys", "read_keys"} {
+		m, _ := parseMetric(name)
+		values := spanValues(spans, s.Regions, m)
+
+		full := "keyvisual_table_" + name
+		p.header(full, "gauge", fmt.Sprintf("The %s of the table or index in the latest interval.", strings.Replace(name, "_", " ", -1)))
+		for i, span := range spans {
+			p.sample(full, float64(values[i]), "db", span.table.DB, "table", span.table.Name,
+				"partition", span.partition, "index", span.index)
+		}
+	}
+}
+
+// metricsHandler exports the traffic of every table and index in the
+// latest stat, and the metrics of the collector.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var p promWriter
+	p.writeCollector()
+
+	now := time.Now()
+	stats, err := stat.rangeStats(now, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(stats) > 0 && !stats[0].Gap {
+		p.writeTables(stats[0], filters.filter(loadTables()))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(p.Bytes())
+}
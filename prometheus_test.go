@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	old := stat
+	defer func() { stat = old }()
+
+	tiers, err := parseTiers(time.Minute, time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiers[0].store = newRingStatStore(60)
+	stat = newTieredStat(tiers)
+
+	oldTables := tables
+	defer func() { tables = oldTables }()
+	tables = newTableHistory()
+	tables.update(1, []*Table{
+		{ID: 20, DB: "test", Name: `t"1`, Indices: map[int64]string{1: "idx"}},
+		{ID: 30, DB: "test", Name: "p", Partitions: []Partition{{ID: 31, Name: "p0"}}},
+	}, time.Now())
+
+	regions := []*regionInfo{
+		newRegionInfo("", GenTableIndexPrefix(20, 1), 0),
+		newRegionInfo(GenTableIndexPrefix(20, 1), GenTableRecordPrefix(20), 10),
+		newRegionInfo(GenTableRecordPrefix(20), "", 20),
+	}
+	regions[2].ReadKeys = 3
+	stat.append(&Stat{Time: time.Now(), Regions: regions})
+	collector.observeScan(1500*time.Millisecond, len(regions))
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, line := range []string{
+		"# TYPE keyvisual_scan_duration_seconds gauge",
+		"keyvisual_scan_duration_seconds 1.5",
+		"keyvisual_region_count 3",
+		`keyvisual_ring_stats{step="1m0s"} 1`,
+		`keyvisual_ring_capacity{step="1m0s"} 60`,
+		`keyvisual_table_written_bytes{db="test",table="t\"1",partition="",index=""} 20`,
+		`keyvisual_table_written_bytes{db="test",table="t\"1",partition="",index="idx"} 10`,
+		`keyvisual_table_read_keys{db="test",table="t\"1",partition="",index=""} 3`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("expect %s in\n%s", line, body)
+		}
+	}
+	// all the series have the same labels
+	if !strings.Contains(body, `keyvisual_table_written_bytes{db="test",table="p",partition="p0",index=""} `) {
+		t.Fatalf("expect the partition in\n%s", body)
+	}
+}
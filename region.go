@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
 	"net/url"
 	"sort"
+	"strings"
+	"time"
+
+	"github.com/pingcap/tidb/util/codec"
 )
 
 type regionInfo struct {
@@ -21,7 +26,7 @@ func (r *regionInfo) String() string {
 	return fmt.Sprintf("[%s, %s)", r.StartKey, r.EndKey)
 }
 
-func scanRegions() []*regionInfo {
+func scanRegions(addr string) ([]*regionInfo, error) {
 	const limit = 1024
 	var key []byte
 	var err error
@@ -29,11 +34,10 @@ func scanRegions() []*regionInfo {
 	for {
 		uri := fmt.Sprintf("pd/api/v1/regions/key?key=%s&limit=%d", url.QueryEscape(string(key)), limit)
 
-		type regionsInfo struct {
-			Regions []*regionInfo `json:"regions"`
-		}
 		var info regionsInfo
-		readBody(*pdAddr, uri, &info)
+		if err = readBody(addr, uri, &info); err != nil {
+			return nil, err
+		}
 
 		if len(info.Regions) == 0 {
 			break
@@ -47,13 +51,19 @@ func scanRegions() []*regionInfo {
 		}
 
 		key, err = hex.DecodeString(lastEndKey)
-		perr(err)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	return regions
+	return regions, nil
 }
 
 func searchRegion(key string, regions []*regionInfo) int {
+	if len(regions) == 0 {
+		return -1
+	}
+
 	i := sort.Search(len(regions), func(i int) bool {
 		return regions[i].StartKey >= key
 	})
@@ -76,13 +86,21 @@ func searchRegion(key string, regions []*regionInfo) int {
 
 func rangeRegionIndices(start string, end string, regions []*regionInfo) (int, int) {
 	startIndex := searchRegion(start, regions)
+	if end == "" {
+		// to the end of the key space
+		if startIndex == -1 {
+			return 0, 0
+		}
+		return startIndex, len(regions)
+	}
 	endIndex := searchRegion(end, regions)
 
 	if startIndex == -1 || endIndex == -1 {
 		return 0, 0
 	}
 
-	if regions[endIndex].EndKey == "" || (regions[endIndex].EndKey > end && regions[endIndex].StartKey != end) {
+	// the region starting at end is out of [start, end) even if it is the last one
+	if regions[endIndex].StartKey != end && (regions[endIndex].EndKey == "" || regions[endIndex].EndKey > end) {
 		endIndex = endIndex + 1
 	}
 
@@ -99,25 +117,211 @@ func rangeRegions(start string, end string, regions [][]*regionInfo) [][]*region
 	return newRegions
 }
 
-func tableHeatmap(heats []Heatmap, t *Table, regions [][]*regionInfo, maxNumber int, getValue func(r *regionInfo) uint64) []Heatmap {
-	// for record
-	startRecord := GenTableRecordPrefix(t.ID)
-	endRecord := GenTableRecordPrefix(t.ID + 1)
+// keyHeatmap builds the heatmap of the regions in [start, end).
+func keyHeatmap(start string, end string, regions [][]*regionInfo, startTime time.Time, endTime time.Time, maxNumber int, squash squashFunc, metrics []*metric) Heatmap {
+	rr := rangeRegions(start, end, regions)
+	return newHeatmap(rr, startTime, endTime, maxNumber, squash, metrics)
+}
 
-	rr := rangeRegions(startRecord, endRecord, regions)
-	h := newHeatmap(rr, maxNumber, getValue)
-	h.Labels = []string{t.DB, t.Name, ""}
+// partitionKey moves the key in the physical table of the partition into
+// the logical table, so the keys of all the partitions are aligned.
+func partitionKey(key string, partID int64, tableID int64) string {
+	v, err := hex.DecodeString(key)
+	if err != nil {
+		return key
+	}
+	suffix, b, err := codec.DecodeBytes(v, nil)
+	if err != nil {
+		return key
+	}
+	prefix := EncodeInt(append([]byte{}, tablePrefix...), partID)
+	if !bytes.HasPrefix(b, prefix) {
+		return key
+	}
 
-	heats = append(heats, h)
-	for idx, name := range t.Indices {
-		startIndex := GenTableIndexPrefix(t.ID, idx)
-		endIndex := GenTableIndexPrefix(t.ID, idx+1)
+	raw := EncodeInt(append([]byte{}, tablePrefix...), tableID)
+	raw = append(raw, b[len(prefix):]...)
+	return strings.ToUpper(hex.EncodeToString(append(EncodeBytes(raw), suffix...)))
+}
 
-		rr = rangeRegions(startIndex, endIndex, regions)
-		h = newHeatmap(rr, maxNumber, getValue)
-		h.Labels = []string{t.DB, t.Name, name}
+// rollupRegions moves the regions of every partition in the range given by
+// bounds into the logical table, and merges them column by column, so the
+// buckets of the heatmap are summed up across the partitions.
+func rollupRegions(t *Table, bounds func(id int64) (string, string), regions []*regionInfo) []*regionInfo {
+	start, end := bounds(t.ID)
+	var regionsVec [][]*regionInfo
+	for _, p := range t.Partitions {
+		partStart, partEnd := bounds(p.ID)
+		startIndex, endIndex := rangeRegionIndices(partStart, partEnd, regions)
+		if startIndex == endIndex {
+			continue
+		}
+
+		moved := make([]*regionInfo, 0, endIndex-startIndex)
+		for _, r := range regions[startIndex:endIndex] {
+			region := *r
+			region.StartKey, region.EndKey = start, end
+			if r.StartKey > partStart {
+				region.StartKey = partitionKey(r.StartKey, p.ID, t.ID)
+			}
+			if r.EndKey != "" && r.EndKey < partEnd {
+				region.EndKey = partitionKey(r.EndKey, p.ID, t.ID)
+			}
+			moved = append(moved, &region)
+		}
+		regionsVec = append(regionsVec, moved)
+	}
+	return mergeRegions(regionsVec)
+}
+
+// rollupHeatmap builds the heatmap of the range given by bounds rolled up
+// across the partitions of the table.
+func rollupHeatmap(t *Table, bounds func(id int64) (string, string), regions [][]*regionInfo, startTime time.Time, endTime time.Time, maxNumber int, squash squashFunc, metrics []*metric) Heatmap {
+	move := func(regions []*regionInfo) []*regionInfo {
+		return rollupRegions(t, bounds, regions)
+	}
+	rr := make([][]*regionInfo, len(regions))
+	for i := range regions {
+		rr[i] = move(regions[i])
+	}
+	h := newHeatmap(rr, startTime, endTime, maxNumber, squash, metrics)
+	h.moveRegions = move
+	return h
+}
+
+// tableHeatmap appends the heatmaps of the records and every index of the
+// table. A partitioned table has the heatmaps of every partition labelled
+// like db.table.partition, or the ones rolled up across the partitions if
+// rollup is set, in which a bucket sums up the same key range of all the
+// partitions.
+func tableHeatmap(heats []Heatmap, t *Table, regions [][]*regionInfo, startTime time.Time, endTime time.Time, maxNumber int, squash squashFunc, metrics []*metric, rollup bool) []Heatmap {
+	if rollup && len(t.Partitions) > 0 {
+		records := func(id int64) (string, string) {
+			return GenTableRecordPrefix(id), GenTableRecordPrefix(id + 1)
+		}
+		h := rollupHeatmap(t, records, regions, startTime, endTime, maxNumber, squash, metrics)
+		h.Labels = []string{t.DB, t.Name, ""}
 		heats = append(heats, h)
+
+		for idx, name := range t.Indices {
+			idx := idx
+			index := func(id int64) (string, string) {
+				return GenTableIndexPrefix(id, idx), GenTableIndexPrefix(id, idx+1)
+			}
+			h = rollupHeatmap(t, index, regions, startTime, endTime, maxNumber, squash, metrics)
+			h.Labels = []string{t.DB, t.Name, name}
+			heats = append(heats, h)
+		}
+		return heats
+	}
+
+	for _, p := range t.partitions() {
+		name := t.partitionName(p)
+
+		// for record
+		h := keyHeatmap(GenTableRecordPrefix(p.ID), GenTableRecordPrefix(p.ID+1), regions, startTime, endTime, maxNumber, squash, metrics)
+		h.Labels = []string{t.DB, name, ""}
+		heats = append(heats, h)
+
+		for idx, index := range t.Indices {
+			h = keyHeatmap(GenTableIndexPrefix(p.ID, idx), GenTableIndexPrefix(p.ID, idx+1), regions, startTime, endTime, maxNumber, squash, metrics)
+			h.Labels = []string{t.DB, name, index}
+			heats = append(heats, h)
+		}
 	}
 
 	return heats
 }
+
+// keySpan is the key range of a table's records or an index.
+type keySpan struct {
+	start string
+	end   string
+	label string
+	table *Table
+	// partition is the name of the partition, empty if the table is not
+	// partitioned.
+	partition string
+	// index is the name of the index, empty for the records.
+	index string
+}
+
+// tableSpans returns the spans of the tables sorted by the start key, every
+// partition has its own spans.
+func tableSpans(tbls []*Table) []keySpan {
+	spans := make([]keySpan, 0, len(tbls))
+	for _, t := range tbls {
+		for _, p := range t.partitions() {
+			label := fmt.Sprintf("%s.%s", t.DB, t.partitionName(p))
+			spans = append(spans, keySpan{
+				start:     GenTableRecordPrefix(p.ID),
+				end:       GenTablePrefix(p.ID + 1),
+				label:     label,
+				table:     t,
+				partition: p.Name,
+			})
+			for idx, name := range t.Indices {
+				spans = append(spans, keySpan{
+					start:     GenTableIndexPrefix(p.ID, idx),
+					end:       GenTableIndexPrefix(p.ID, idx+1),
+					label:     fmt.Sprintf("%s.%s", label, name),
+					table:     t,
+					partition: p.Name,
+					index:     name,
+				})
+			}
+		}
+	}
+
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].start < spans[j].start
+	})
+	return spans
+}
+
+// coveredLabels returns the labels of the spans overlapping [start, end),
+// the empty end means the end of the key space.
+func coveredLabels(spans []keySpan, start string, end string) []string {
+	i := sort.Search(len(spans), func(i int) bool {
+		return spans[i].end > start
+	})
+
+	var labels []string
+	for ; i < len(spans) && (end == "" || spans[i].start < end); i++ {
+		labels = append(labels, spans[i].label)
+	}
+	return labels
+}
+
+// clusterHeatmap builds the heatmap of the whole key space, including the
+// ranges belonging to no known table, and labels every bucket with the
+// tables and indices it covers.
+func clusterHeatmap(tbls []*Table, regions [][]*regionInfo, startTime time.Time, endTime time.Time, maxNumber int, squash squashFunc, metrics []*metric) Heatmap {
+	h := newHeatmap(regions, startTime, endTime, maxNumber, squash, metrics)
+	h.Labels = []string{"cluster", "", ""}
+
+	spans := tableSpans(tbls)
+	h.RangeLabels = make([][]string, len(h.Ranges))
+	for i, r := range h.Ranges {
+		h.RangeLabels[i] = coveredLabels(spans, r.StartKey.Desc, r.EndKey.Desc)
+	}
+	return h
+}
+
+// spanValues sums the counters of the regions in every span and derives the
+// metric from them, the region crossing spans is counted in all of them.
+func spanValues(spans []keySpan, regions []*regionInfo, m *metric) []uint64 {
+	values := make([]uint64, len(spans))
+	buf := make([]uint64, len(m.counters))
+	for i, span := range spans {
+		start, end := rangeRegionIndices(span.start, span.end, regions)
+		for k, name := range m.counters {
+			buf[k] = 0
+			for _, r := range regions[start:end] {
+				buf[k] += counters[name](r)
+			}
+		}
+		values[i] = m.derive(buf)
+	}
+	return values
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestSearchRegion(t *testing.T) {
@@ -47,4 +49,129 @@ func TestRangeRegions(t *testing.T) {
 	check(encodeTablePrefix(4), encodeTableIndexPrefix(4, 1), 2, 3)
 	check(encodeTablePrefix(5), encodeTablePrefix(6), 3, 4)
 	check(encodeTablePrefix(3), encodeTablePrefix(6), 2, 4)
+	check(encodeTablePrefix(3), "", 2, 4)
+	check("", "", 0, 4)
+}
+
+func TestRangeRegionsLastRegion(t *testing.T) {
+	regions := []*regionInfo{
+		newRegionInfo("", encodeTablePrefix(3), 10),
+		newRegionInfo(encodeTablePrefix(3), encodeTablePrefix(5), 20),
+		newRegionInfo(encodeTablePrefix(5), "", 30),
+	}
+
+	// the last region starts at the end, it belongs to the next range
+	if r1, r2 := rangeRegionIndices(encodeTablePrefix(3), encodeTablePrefix(5), regions); r1 != 1 || r2 != 2 {
+		t.Fatalf("expected [1, 2) but got [%d, %d)", r1, r2)
+	}
+	if r1, r2 := rangeRegionIndices(encodeTablePrefix(4), encodeTablePrefix(6), regions); r1 != 1 || r2 != 3 {
+		t.Fatalf("expected [1, 3) but got [%d, %d)", r1, r2)
+	}
+}
+
+func TestClusterHeatmap(t *testing.T) {
+	tbls := []*Table{
+		{ID: 1, DB: "test", Name: "a", Indices: map[int64]string{1: "idx"}},
+		{ID: 3, DB: "test", Name: "b"},
+	}
+
+	regions := [][]*regionInfo{
+		{
+			newRegionInfo("", GenTableIndexPrefix(1, 1), 10),
+			newRegionInfo(GenTableIndexPrefix(1, 1), GenTableRecordPrefix(1), 20),
+			newRegionInfo(GenTableRecordPrefix(1), GenTablePrefix(3), 30),
+			newRegionInfo(GenTablePrefix(3), "", 40),
+		},
+	}
+
+	h := clusterHeatmap(tbls, regions, time.Now(), time.Now(), 10, squashRanges, writtenBytes)
+
+	expectedLabels := [][]string{
+		nil,
+		{"test.a.idx"},
+		{"test.a"},
+		{"test.b"},
+	}
+	if !reflect.DeepEqual(h.RangeLabels, expectedLabels) {
+		t.Fatalf("want %v, but got %v", expectedLabels, h.RangeLabels)
+	}
+
+	expectedValues := [][]uint64{{10}, {20}, {30}, {40}}
+	if !reflect.DeepEqual(h.Values, expectedValues) {
+		t.Fatalf("want %v, but got %v", expectedValues, h.Values)
+	}
+
+	// the squashed bucket covers all of them
+	h = clusterHeatmap(tbls, regions, time.Now(), time.Now(), 1, squashRanges, writtenBytes)
+	expectedLabels = [][]string{{"test.a.idx", "test.a", "test.b"}}
+	if !reflect.DeepEqual(h.RangeLabels, expectedLabels) {
+		t.Fatalf("want %v, but got %v", expectedLabels, h.RangeLabels)
+	}
+}
+
+func TestPartitionHeatmap(t *testing.T) {
+	tbl := &Table{
+		ID: 1, DB: "test", Name: "t",
+		Partitions: []Partition{{ID: 2, Name: "p0"}, {ID: 4, Name: "p1"}},
+	}
+
+	regions := [][]*regionInfo{
+		{
+			newRegionInfo("", GenTableRecordPrefix(2), 10),
+			newRegionInfo(GenTableRecordPrefix(2), GenTableRecordPrefix(3), 20),
+			newRegionInfo(GenTableRecordPrefix(3), GenTableRecordPrefix(4), 30),
+			newRegionInfo(GenTableRecordPrefix(4), "", 40),
+		},
+	}
+
+	heats := tableHeatmap(nil, tbl, regions, time.Now(), time.Now(), 10, squashRanges, writtenBytes, false)
+	if len(heats) != 2 {
+		t.Fatalf("want 2 heatmaps, but got %d", len(heats))
+	}
+	for i, name := range []string{"t.p0", "t.p1"} {
+		if !reflect.DeepEqual(heats[i].Labels, []string{"test", name, ""}) {
+			t.Fatalf("unexpected labels %v", heats[i].Labels)
+		}
+	}
+	if !reflect.DeepEqual(heats[0].Values, [][]uint64{{20}}) || !reflect.DeepEqual(heats[1].Values, [][]uint64{{40}}) {
+		t.Fatalf("unexpected values %v %v", heats[0].Values, heats[1].Values)
+	}
+
+	// the same key ranges of the partitions are summed up
+	regions = [][]*regionInfo{
+		{
+			newRegionInfo("", GenTableRecordPrefix(2), 1),
+			newRegionInfo(GenTableRecordPrefix(2), GenTableRecordKey(2, 100), 10),
+			newRegionInfo(GenTableRecordKey(2, 100), GenTableRecordPrefix(4), 20),
+			newRegionInfo(GenTableRecordPrefix(4), GenTableRecordKey(4, 100), 5),
+			newRegionInfo(GenTableRecordKey(4, 100), "", 40),
+		},
+	}
+	heats = tableHeatmap(nil, tbl, regions, time.Now(), time.Now(), 10, squashRanges, writtenBytes, true)
+	if len(heats) != 1 || !reflect.DeepEqual(heats[0].Labels, []string{"test", "t", ""}) {
+		t.Fatalf("unexpected heatmaps %v", heats)
+	}
+	if !reflect.DeepEqual(heats[0].Values, [][]uint64{{15}, {60}}) {
+		t.Fatalf("unexpected values %v", heats[0].Values)
+	}
+	var keys []string
+	for _, r := range heats[0].Ranges {
+		keys = append(keys, r.StartKey.Desc, r.EndKey.Desc)
+	}
+	expectedKeys := []string{GenTableRecordPrefix(1), GenTableRecordKey(1, 100), GenTableRecordKey(1, 100), GenTableRecordPrefix(2)}
+	if !reflect.DeepEqual(keys, expectedKeys) {
+		t.Fatalf("want %v, but got %v", expectedKeys, keys)
+	}
+	// the regions of a new stat are rolled up the same way
+	if moved := heats[0].moveRegions(regions[0]); len(moved) != 2 || moved[1].WrittenBytes != 60 {
+		t.Fatalf("unexpected regions %v", moved)
+	}
+
+	var labels []string
+	for _, span := range tableSpans([]*Table{tbl}) {
+		labels = append(labels, span.label)
+	}
+	if !reflect.DeepEqual(labels, []string{"test.t.p0", "test.t.p1"}) {
+		t.Fatalf("unexpected span labels %v", labels)
+	}
 }
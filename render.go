@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// colorScales are the gradients from the lowest value to the highest.
+var colorScales = map[string][]color.RGBA{
+	"heat": {
+		{0, 0, 0, 255}, {128, 0, 0, 255}, {255, 64, 0, 255}, {255, 200, 0, 255}, {255, 255, 255, 255},
+	},
+	"gray": {
+		{0, 0, 0, 255}, {255, 255, 255, 255},
+	},
+	"viridis": {
+		{68, 1, 84, 255}, {59, 82, 139, 255}, {33, 145, 140, 255}, {94, 201, 98, 255}, {253, 231, 37, 255},
+	},
+}
+
+// valueScales map the value to [0, 1] by the max value.
+var valueScales = map[string]func(v uint64, max uint64) float64{
+	"linear": func(v uint64, max uint64) float64 {
+		return float64(v) / float64(max)
+	},
+	"sqrt": func(v uint64, max uint64) float64 {
+		return math.Sqrt(float64(v) / float64(max))
+	},
+	"log": func(v uint64, max uint64) float64 {
+		return math.Log1p(float64(v)) / math.Log1p(float64(max))
+	},
+}
+
+var (
+	gapColor  = color.RGBA{220, 220, 220, 255}
+	textColor = color.RGBA{0, 0, 0, 255}
+)
+
+func gradient(stops []color.RGBA, f float64) color.RGBA {
+	if f <= 0 || math.IsNaN(f) {
+		return stops[0]
+	}
+	if f >= 1 {
+		return stops[len(stops)-1]
+	}
+
+	pos := f * float64(len(stops)-1)
+	i := int(pos)
+	t := pos - float64(i)
+	a, b := stops[i], stops[i+1]
+	lerp := func(x, y uint8) uint8 {
+		return uint8(float64(x) + (float64(y)-float64(x))*t + 0.5)
+	}
+	return color.RGBA{lerp(a.R, b.R), lerp(a.G, b.G), lerp(a.B, b.B), 255}
+}
+
+// glyphs is a 3x5 pixel font of the characters in the labels and the times,
+// the lower case letters are drawn in upper case.
+var glyphs = map[rune][5]string{
+	'0': {"111", "101", "101", "101", "111"},
+	'1': {"010", "110", "010", "010", "111"},
+	'2': {"111", "001", "111", "100", "111"},
+	'3': {"111", "001", "111", "001", "111"},
+	'4': {"101", "101", "111", "001", "001"},
+	'5': {"111", "100", "111", "001", "111"},
+	'6': {"111", "100", "111", "101", "111"},
+	'7': {"111", "001", "010", "010", "010"},
+	'8': {"111", "101", "111", "101", "111"},
+	'9': {"111", "101", "111", "001", "111"},
+	'A': {"010", "101", "111", "101", "101"},
+	'B': {"110", "101", "110", "101", "110"},
+	'C': {"011", "100", "100", "100", "011"},
+	'D': {"110", "101", "101", "101", "110"},
+	'E': {"111", "100", "110", "100", "111"},
+	'F': {"111", "100", "110", "100", "100"},
+	'G': {"011", "100", "101", "101", "011"},
+	'H': {"101", "101", "111", "101", "101"},
+	'I': {"111", "010", "010", "010", "111"},
+	'J': {"001", "001", "001", "101", "010"},
+	'K': {"101", "101", "110", "101", "101"},
+	'L': {"100", "100", "100", "100", "111"},
+	'M': {"101", "111", "101", "101", "101"},
+	'N': {"110", "101", "101", "101", "101"},
+	'O': {"010", "101", "101", "101", "010"},
+	'P': {"110", "101", "110", "100", "100"},
+	'Q': {"010", "101", "101", "110", "011"},
+	'R': {"110", "101", "110", "101", "101"},
+	'S': {"011", "100", "010", "001", "110"},
+	'T': {"111", "010", "010", "010", "010"},
+	'U': {"101", "101", "101", "101", "111"},
+	'V': {"101", "101", "101", "101", "010"},
+	'W': {"101", "101", "101", "111", "101"},
+	'X': {"101", "101", "010", "101", "101"},
+	'Y': {"101", "101", "010", "010", "010"},
+	'Z': {"111", "001", "010", "100", "111"},
+	'.': {"000", "000", "000", "000", "010"},
+	',': {"000", "000", "000", "010", "100"},
+	':': {"000", "010", "000", "010", "000"},
+	'-': {"000", "000", "111", "000", "000"},
+	'_': {"000", "000", "000", "000", "111"},
+	'+': {"000", "010", "111", "010", "000"},
+	'=': {"000", "111", "000", "111", "000"},
+	'/': {"001", "001", "010", "100", "100"},
+	'(': {"010", "100", "100", "100", "010"},
+	')': {"010", "001", "001", "001", "010"},
+	'?': {"111", "001", "010", "000", "010"},
+	' ': {"000", "000", "000", "000", "000"},
+}
+
+const (
+	// the glyphs are drawn in fontScale x fontScale pixels
+	fontScale   = 2
+	charWidth   = 4 * fontScale
+	charHeight  = 5 * fontScale
+	imagePad    = 8
+	lineHeight  = charHeight + imagePad
+	bandSpacing = 4
+	legendWidth = 100
+
+	// maxImagePixels and maxSVGRects bound the memory and the size of an
+	// image of many heatmaps
+	maxImagePixels = 1 << 24
+	maxSVGRects    = 1 << 20
+)
+
+// heatmapImage lays out the heatmaps stacked from the top, with the labels
+// on the left and the time ticks at the bottom.
+type heatmapImage struct {
+	out    outStat
+	title  string
+	colors []color.RGBA
+	scale  func(v uint64, max uint64) float64
+	max    uint64
+	isGap  []bool
+
+	left       int
+	width      int
+	bandHeight int
+}
+
+func newHeatmapImage(out outStat, title string, colors []color.RGBA, scale func(v uint64, max uint64) float64, width int, bandHeight int) *heatmapImage {
+	im := &heatmapImage{
+		out:        out,
+		title:      title,
+		colors:     colors,
+		scale:      scale,
+		isGap:      make([]bool, len(out.Times)),
+		width:      width,
+		bandHeight: bandHeight,
+	}
+	for _, i := range out.Gaps {
+		im.isGap[i] = true
+	}
+
+	labelChars := 0
+	for _, h := range out.Heatmaps {
+		if n := len(heatmapLabel(h)); n > labelChars {
+			labelChars = n
+		}
+		for _, row := range h.Values {
+			for j, v := range row {
+				if !im.isGap[j] && v > im.max {
+					im.max = v
+				}
+			}
+		}
+	}
+	im.left = imagePad + labelChars*charWidth + imagePad
+	return im
+}
+
+func heatmapLabel(h Heatmap) string {
+	var parts []string
+	for _, l := range h.Labels {
+		if l != "" {
+			parts = append(parts, l)
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+func (im *heatmapImage) size() (int, int) {
+	w := im.left + im.width + imagePad
+	h := lineHeight + len(im.out.Heatmaps)*(im.bandHeight+bandSpacing) + 2*lineHeight + imagePad
+	return w, h
+}
+
+// tooLarge returns the error if the image exceeds maxImagePixels, or the SVG
+// exceeds maxSVGRects.
+func (im *heatmapImage) tooLarge(format string) error {
+	width, height := im.size()
+	if width*height > maxImagePixels {
+		return fmt.Errorf("the image of %d heatmaps is %dx%d pixels, more than %d", len(im.out.Heatmaps), width, height, maxImagePixels)
+	}
+	if format != "svg" {
+		return nil
+	}
+	rects := 0
+	for _, h := range im.out.Heatmaps {
+		rects += len(h.Ranges) * len(im.out.Times)
+	}
+	if rects > maxSVGRects {
+		return fmt.Errorf("the image of %d heatmaps has %d buckets, more than %d", len(im.out.Heatmaps), rects, maxSVGRects)
+	}
+	return nil
+}
+
+func (im *heatmapImage) bandTop(i int) int {
+	return lineHeight + i*(im.bandHeight+bandSpacing)
+}
+
+// color returns the color of the bucket in the column.
+func (im *heatmapImage) color(h Heatmap, row int, col int) color.RGBA {
+	return im.blockColor(h, row, row+1, col, col+1)
+}
+
+// blockColor returns the color of the buckets in the rows [row, rowEnd) and
+// the columns [col, colEnd) drawn at the same pixel. It is the color of the
+// max value so a hot bucket is never hidden, or the gap color if all the
+// columns are gaps.
+func (im *heatmapImage) blockColor(h Heatmap, row int, rowEnd int, col int, colEnd int) color.RGBA {
+	var value uint64
+	isGap := true
+	for j := col; j < colEnd; j++ {
+		if im.isGap[j] {
+			continue
+		}
+		isGap = false
+		for i := row; i < rowEnd; i++ {
+			if v := h.Values[i][j]; v > value {
+				value = v
+			}
+		}
+	}
+	if isGap {
+		return gapColor
+	}
+	if im.max == 0 {
+		return im.colors[0]
+	}
+	return gradient(im.colors, im.scale(value, im.max))
+}
+
+// pixelSpan returns the items [start, end) of n drawn at the pixel i of
+// size pixels, at least one.
+func pixelSpan(i int, n int, size int) (int, int) {
+	start, end := i*n/size, (i+1)*n/size
+	if end == start {
+		end = start + 1
+	}
+	return start, end
+}
+
+type imageText struct {
+	x, y int
+	s    string
+}
+
+// texts returns the title, the labels, the time ticks and the legend.
+func (im *heatmapImage) texts() []imageText {
+	texts := []imageText{{imagePad, imagePad / 2, im.title}}
+	for i, h := range im.out.Heatmaps {
+		y := im.bandTop(i) + (im.bandHeight-charHeight)/2
+		texts = append(texts, imageText{imagePad, y, heatmapLabel(h)})
+	}
+
+	axis := im.bandTop(len(im.out.Heatmaps)) + bandSpacing
+	width, _ := im.size()
+	for _, t := range im.ticks() {
+		// keep the labels of the first and last ticks in the image
+		x := t.x - len(t.label)*charWidth/2
+		if max := width - len(t.label)*charWidth; x > max {
+			x = max
+		}
+		texts = append(texts, imageText{x, axis + bandSpacing, t.label})
+	}
+
+	legend := axis + lineHeight
+	maxLabel := strconv.FormatUint(im.max, 10)
+	texts = append(texts,
+		imageText{im.left - imagePad - charWidth, legend, "0"},
+		imageText{im.left + legendWidth + imagePad, legend, maxLabel})
+	return texts
+}
+
+type imageTick struct {
+	x     int
+	label string
+}
+
+// ticks returns the time ticks about every 120 pixels.
+func (im *heatmapImage) ticks() []imageTick {
+	times := im.out.Times
+	if len(times) == 0 {
+		return nil
+	}
+	layout := "15:04"
+	if times[len(times)-1].Sub(times[0]) >= 24*time.Hour {
+		layout = "01-02 15:04"
+	}
+
+	n := im.width / 120
+	if n < 2 {
+		n = 2
+	}
+	if n > len(times) {
+		n = len(times)
+	}
+	var ticks []imageTick
+	for k := 0; k < n; k++ {
+		j := 0
+		if n > 1 {
+			j = k * (len(times) - 1) / (n - 1)
+		}
+		x := im.left + (2*j+1)*im.width/(2*len(times))
+		ticks = append(ticks, imageTick{x, times[j].Format(layout)})
+	}
+	return ticks
+}
+
+func (im *heatmapImage) legendTop() int {
+	return im.bandTop(len(im.out.Heatmaps)) + bandSpacing + lineHeight
+}
+
+func fillRect(img *image.RGBA, x0, y0, x1, y1 int, c color.RGBA) {
+	for y := y0; y < y1; y++ {
+		for x := x0; x < x1; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+func drawText(img *image.RGBA, x int, y int, s string, c color.RGBA) {
+	for _, r := range strings.ToUpper(s) {
+		g, ok := glyphs[r]
+		if !ok {
+			g = glyphs['?']
+		}
+		for gy, row := range g {
+			for gx, bit := range row {
+				if bit == '1' {
+					px, py := x+gx*fontScale, y+gy*fontScale
+					fillRect(img, px, py, px+fontScale, py+fontScale, c)
+				}
+			}
+		}
+		x += charWidth
+	}
+}
+
+func (im *heatmapImage) writePNG(w io.Writer) error {
+	width, height := im.size()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	fillRect(img, 0, 0, width, height, color.RGBA{255, 255, 255, 255})
+
+	for i, h := range im.out.Heatmaps {
+		top := im.bandTop(i)
+		rows, cols := len(h.Ranges), len(im.out.Times)
+		if rows == 0 || cols == 0 {
+			fillRect(img, im.left, top, im.left+im.width, top+im.bandHeight, gapColor)
+			continue
+		}
+		for py := 0; py < im.bandHeight; py++ {
+			row, rowEnd := pixelSpan(py, rows, im.bandHeight)
+			for px := 0; px < im.width; px++ {
+				col, colEnd := pixelSpan(px, cols, im.width)
+				img.SetRGBA(im.left+px, top+py, im.blockColor(h, row, rowEnd, col, colEnd))
+			}
+		}
+	}
+
+	axis := im.bandTop(len(im.out.Heatmaps))
+	for _, t := range im.ticks() {
+		fillRect(img, t.x, axis, t.x+1, axis+bandSpacing, textColor)
+	}
+	legend := im.legendTop()
+	for px := 0; px < legendWidth; px++ {
+		c := gradient(im.colors, float64(px)/float64(legendWidth-1))
+		fillRect(img, im.left+px, legend, im.left+px+1, legend+charHeight, c)
+	}
+	for _, t := range im.texts() {
+		drawText(img, t.x, t.y, t.s, textColor)
+	}
+
+	return png.Encode(w, img)
+}
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func (im *heatmapImage) writeSVG(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	width, height := im.size()
+	fmt.Fprintf(bw, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`+"\n",
+		width, height, width, height)
+	fmt.Fprintf(bw, `<rect width="%d" height="%d" fill="#ffffff"/>`+"\n", width, height)
+
+	for i, h := range im.out.Heatmaps {
+		top := im.bandTop(i)
+		rows, cols := len(h.Ranges), len(im.out.Times)
+		if rows == 0 || cols == 0 {
+			fmt.Fprintf(bw, `<rect x="%d" y="%d" width="%d" height="%d" fill="%s"/>`+"\n",
+				im.left, top, im.width, im.bandHeight, svgColor(gapColor))
+			continue
+		}
+		cw, rh := float64(im.width)/float64(cols), float64(im.bandHeight)/float64(rows)
+		fmt.Fprintf(bw, "<g><title>%s</title>\n", xmlEscape(heatmapLabel(h)))
+		for row := 0; row < rows; row++ {
+			for col := 0; col < cols; col++ {
+				fmt.Fprintf(bw, `<rect x="%.2f" y="%.2f" width="%.2f" height="%.2f" fill="%s"/>`+"\n",
+					float64(im.left)+float64(col)*cw, float64(top)+float64(row)*rh, cw, rh, svgColor(im.color(h, row, col)))
+			}
+		}
+		bw.WriteString("</g>\n")
+	}
+
+	axis := im.bandTop(len(im.out.Heatmaps))
+	for _, t := range im.ticks() {
+		fmt.Fprintf(bw, `<line x1="%d" y1="%d" x2="%d" y2="%d" stroke="#000000"/>`+"\n", t.x, axis, t.x, axis+bandSpacing)
+	}
+	legend := im.legendTop()
+	bw.WriteString(`<defs><linearGradient id="legend">`)
+	for i, c := range im.colors {
+		fmt.Fprintf(bw, `<stop offset="%.2f" stop-color="%s"/>`, float64(i)/float64(len(im.colors)-1), svgColor(c))
+	}
+	bw.WriteString("</linearGradient></defs>\n")
+	fmt.Fprintf(bw, `<rect x="%d" y="%d" width="%d" height="%d" fill="url(#legend)"/>`+"\n", im.left, legend, legendWidth, charHeight)
+	for _, t := range im.texts() {
+		fmt.Fprintf(bw, `<text x="%d" y="%d" font-family="monospace" font-size="%d">%s</text>`+"\n",
+			t.x, t.y+charHeight, charHeight+2, xmlEscape(t.s))
+	}
+
+	bw.WriteString("</svg>\n")
+	return bw.Flush()
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// imageHandler renders the heatmaps of the same query as /heatmaps to
+// format=png or svg, like color=heat&scale=log&width=600&height=64, the
+// height is of every heatmap.
+func imageHandler(w http.ResponseWriter, r *http.Request) {
+	req, err := parseHeatmapRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sc, err := parseHeatmapScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := r.FormValue("format")
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("color")
+	if name == "" {
+		name = "heat"
+	}
+	colors, ok := colorScales[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown color %q", name), http.StatusBadRequest)
+		return
+	}
+	name = r.FormValue("scale")
+	if name == "" {
+		name = "log"
+	}
+	scale, ok := valueScales[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown scale %q", name), http.StatusBadRequest)
+		return
+	}
+	size := func(key string, value int) (int, error) {
+		if v := r.FormValue(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 || n > 4096 {
+				return 0, fmt.Errorf("invalid %s %q", key, v)
+			}
+			return n, nil
+		}
+		return value, nil
+	}
+	width, err := size("width", 600)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	bandHeight := 64
+	if sc.cluster {
+		bandHeight = 256
+	}
+	if bandHeight, err = size("height", bandHeight); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cols, err := req.loadColumns()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cols == nil {
+		http.Error(w, "no stat yet", http.StatusNotFound)
+		return
+	}
+
+	out := req.output(cols, sc.build(req, cols))
+	title := fmt.Sprintf("%s %s - %s", req.metrics[0].name, out.StartTime.Format("2006-01-02 15:04"), out.EndTime.Format("2006-01-02 15:04"))
+	im := newHeatmapImage(out, title, colors, scale, width, bandHeight)
+	if err = im.tooLarge(format); err != nil {
+		http.Error(w, err.Error()+", narrow the query or lower the width and the height", http.StatusBadRequest)
+		return
+	}
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		err = im.writeSVG(w)
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		err = im.writePNG(w)
+	}
+	if err != nil {
+		log.Printf("write the heatmap image failed: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderHeatmap(t *testing.T) {
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	out := outStat{
+		Times: []time.Time{now, now.Add(time.Minute), now.Add(2 * time.Minute)},
+		Gaps:  []int{1},
+		Heatmaps: []Heatmap{
+			{Labels: []string{"test", "t", ""}, Ranges: make([]Range, 2), Values: [][]uint64{{0, 0, 100}, {50, 0, 0}}},
+			{Labels: []string{"test", "t", "idx"}, Ranges: make([]Range, 1), Values: [][]uint64{{10, 0, 10}}},
+		},
+	}
+
+	im := newHeatmapImage(out, "written_bytes", colorScales["heat"], valueScales["linear"], 30, 20)
+	var buf bytes.Buffer
+	if err := im.writePNG(&buf); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	width, height := im.size()
+	if img.Bounds().Dx() != width || img.Bounds().Dy() != height {
+		t.Fatalf("unexpected size %v", img.Bounds())
+	}
+
+	check := func(x int, y int, expected color.RGBA) {
+		r, g, b, _ := img.At(x, y).RGBA()
+		if uint8(r>>8) != expected.R || uint8(g>>8) != expected.G || uint8(b>>8) != expected.B {
+			t.Fatalf("want %v, but got %v at (%d, %d)", expected, img.At(x, y), x, y)
+		}
+	}
+	top := im.bandTop(0)
+	// the max value, the gap and the zero value
+	check(im.left+25, top+5, colorScales["heat"][4])
+	check(im.left+15, top+5, gapColor)
+	check(im.left+5, top+5, colorScales["heat"][0])
+
+	buf.Reset()
+	if err := im.writeSVG(&buf); err != nil {
+		t.Fatal(err)
+	}
+	svg := buf.String()
+	for _, s := range []string{"<svg", "<title>test.t.idx</title>", ">10:00</text>", `fill="#ffffff"`} {
+		if !strings.Contains(svg, s) {
+			t.Fatalf("expect %s in %s", s, svg)
+		}
+	}
+}
+
+func TestImageHandler(t *testing.T) {
+	old := stat
+	defer func() { stat = old }()
+	s := newRingStatStore(10)
+	stat = s
+	s.append(&Stat{Time: time.Now(), Regions: []*regionInfo{newRegionInfo("", "", 10)}})
+
+	w := httptest.NewRecorder()
+	imageHandler(w, httptest.NewRequest("GET", "/heatmaps/image?scope=cluster&start=-1m&color=viridis&scale=sqrt", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body)
+	}
+	if _, err := png.Decode(w.Body); err != nil {
+		t.Fatal(err)
+	}
+
+	// the image is too large
+	w = httptest.NewRecorder()
+	imageHandler(w, httptest.NewRequest("GET", "/heatmaps/image?scope=cluster&start=-1m&width=4096&height=4096", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expect bad request for the large image, but got %d", w.Code)
+	}
+
+	for _, query := range []string{"format=gif", "color=rainbow", "scale=cubic", "width=0"} {
+		w = httptest.NewRecorder()
+		imageHandler(w, httptest.NewRequest("GET", "/heatmaps/image?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expect bad request for %s, but got %d", query, w.Code)
+		}
+	}
+}
+
+func TestRenderHotBucket(t *testing.T) {
+	now := time.Date(2026, 1, 1, 10, 0, 0, 0, time.UTC)
+	times := make([]time.Time, 1000)
+	for i := range times {
+		times[i] = now.Add(time.Duration(i) * time.Minute)
+	}
+	values := make([][]uint64, 256)
+	for i := range values {
+		values[i] = make([]uint64, len(times))
+	}
+	// the only hot bucket is drawn at the same pixel as 3 cold rows and 9
+	// cold columns
+	values[3][3] = 100
+	out := outStat{
+		Times:    times,
+		Heatmaps: []Heatmap{{Labels: []string{"test", "t", ""}, Ranges: make([]Range, len(values)), Values: values}},
+	}
+
+	im := newHeatmapImage(out, "written_bytes", colorScales["heat"], valueScales["linear"], 100, 64)
+	var buf bytes.Buffer
+	if err := im.writePNG(&buf); err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := colorScales["heat"][4]
+	r, g, b, _ := img.At(im.left, im.bandTop(0)).RGBA()
+	if uint8(r>>8) != expected.R || uint8(g>>8) != expected.G || uint8(b>>8) != expected.B {
+		t.Fatalf("want %v, but got %v", expected, img.At(im.left, im.bandTop(0)))
+	}
+}
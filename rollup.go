@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tier keeps the stats of a resolution for the retention.
+type tier struct {
+	step      time.Duration
+	retention time.Duration
+	store     statStore
+
+	// pending is the start time of the step not rolled up yet.
+	pending time.Time
+}
+
+// parseTiers parses the rollups like "10m:168h,1h:720h" into the tiers after
+// the raw one, every step must be a multiple of the previous one.
+func parseTiers(step time.Duration, retention time.Duration, rollups string) ([]*tier, error) {
+	tiers := []*tier{{step: step, retention: retention}}
+	for _, rollup := range strings.Split(rollups, ",") {
+		rollup = strings.TrimSpace(rollup)
+		if rollup == "" {
+			continue
+		}
+
+		fields := strings.Split(rollup, ":")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid rollup %q, want step:retention", rollup)
+		}
+		s, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		r, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return nil, err
+		}
+
+		prev := tiers[len(tiers)-1].step
+		if s <= prev || s%prev != 0 {
+			return nil, fmt.Errorf("invalid rollup %q, step must be a multiple of %s", rollup, prev)
+		}
+		tiers = append(tiers, &tier{step: s, retention: r})
+	}
+	return tiers, nil
+}
+
+// TieredStat saves the raw stats in the first tier, and rolls them up into
+// the coarser tiers, so the old stats are kept in a lower resolution instead
+// of being dropped.
+type TieredStat struct {
+	sync.Mutex
+
+	tiers []*tier
+}
+
+func newTieredStat(tiers []*tier) *TieredStat {
+	return &TieredStat{tiers: tiers}
+}
+
+func (t *TieredStat) append(s *Stat) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if err := t.tiers[0].store.append(s); err != nil {
+		return err
+	}
+
+	for i := 1; i < len(t.tiers); i++ {
+		if err := t.rollup(i, s.Time); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollup merges the stats of every finished step in the previous tier into
+// the tier. After restarting, it resumes from the step after the latest
+// rollup kept in the tier, or from the oldest stat of the previous tier, so
+// the steps finished while the process was down are rolled up too.
+func (t *TieredStat) rollup(i int, now time.Time) error {
+	cur := t.tiers[i]
+	end := now.Truncate(cur.step)
+	if cur.pending.IsZero() {
+		pending, err := t.resume(i, now)
+		if err != nil {
+			return err
+		}
+		cur.pending = pending
+	}
+	// the older steps are out of the retention
+	if oldest := end.Add(-cur.retention).Truncate(cur.step); cur.pending.Before(oldest) {
+		cur.pending = oldest
+	}
+
+	// more than one step is finished after restarting or a jump of the clock
+	for cur.pending.Before(end) {
+		if err := t.rollupStep(i, cur.pending); err != nil {
+			return err
+		}
+		cur.pending = cur.pending.Add(cur.step)
+	}
+	return nil
+}
+
+// resume returns the start time of the first step of the tier not rolled up
+// yet.
+func (t *TieredStat) resume(i int, now time.Time) (time.Time, error) {
+	cur, prev := t.tiers[i], t.tiers[i-1]
+	stats, err := cur.store.rangeStats(now.Add(-cur.retention), now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(stats) > 0 {
+		return stats[len(stats)-1].Time.Truncate(cur.step).Add(cur.step), nil
+	}
+
+	stats, err = prev.store.rangeStats(now.Add(-prev.retention), now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(stats) > 0 {
+		return stats[0].Time.Truncate(cur.step), nil
+	}
+	return now.Truncate(cur.step), nil
+}
+
+// rollupStep merges the stats of the step starting at start in the previous
+// tier into one stat of the tier.
+func (t *TieredStat) rollupStep(i int, start time.Time) error {
+	cur := t.tiers[i]
+	end := start.Add(cur.step)
+	stats, err := t.tiers[i-1].store.rangeStats(start, end)
+	if err != nil {
+		return err
+	}
+
+	regionsVec := make([][]*regionInfo, 0, len(stats))
+	for _, s := range stats {
+		// the store may return the stats out of the step
+		if s.Gap || s.Time.Before(start) || !s.Time.Before(end) {
+			continue
+		}
+		regionsVec = append(regionsVec, s.Regions)
+	}
+
+	s := &Stat{
+		Time:     start,
+		Interval: cur.step,
+		Regions:  mergeRegions(regionsVec),
+		Gap:      len(regionsVec) == 0,
+	}
+	return cur.store.append(s)
+}
+
+// rangeStats returns the stats from the finest tier still keeping the
+// start time.
+func (t *TieredStat) rangeStats(startTime time.Time, endTime time.Time) ([]*Stat, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	cur := t.tiers[len(t.tiers)-1]
+	for _, tier := range t.tiers {
+		if !startTime.Before(now.Add(-tier.retention)) {
+			cur = tier
+			break
+		}
+	}
+
+	return cur.store.rangeStats(startTime.Truncate(cur.step), endTime)
+}
+
+// mergeRegions merges the snapshots of regions by the key ranges, the
+// counters of a region are split evenly into the ranges it covers and
+// summed up with the other snapshots.
+func mergeRegions(regionsVec [][]*regionInfo) []*regionInfo {
+	if len(regionsVec) == 0 {
+		return nil
+	}
+
+	ranges := buildRanges(regionsVec)
+	merged := make([]*regionInfo, len(ranges))
+	for i, r := range ranges {
+		merged[i] = &regionInfo{
+			StartKey: r.Start,
+			EndKey:   r.End,
+		}
+	}
+
+	for _, regions := range regionsVec {
+		coverRanges(ranges, regions, func(region *regionInfo, start int, end int) {
+			count := uint64(end - start)
+			for j := start; j < end; j++ {
+				merged[j].WrittenBytes += region.WrittenBytes / count
+				merged[j].ReadBytes += region.ReadBytes / count
+				merged[j].WrittenKeys += region.WrittenKeys / count
+				merged[j].ReadKeys += region.ReadKeys / count
+			}
+		})
+	}
+
+	return merged
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseTiers(t *testing.T) {
+	tiers, err := parseTiers(time.Minute, 6*time.Hour, "10m:168h, 1h:720h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][2]time.Duration{
+		{time.Minute, 6 * time.Hour},
+		{10 * time.Minute, 168 * time.Hour},
+		{time.Hour, 720 * time.Hour},
+	}
+	if len(tiers) != len(expected) {
+		t.Fatalf("want %d tiers, but got %d", len(expected), len(tiers))
+	}
+	for i, e := range expected {
+		if tiers[i].step != e[0] || tiers[i].retention != e[1] {
+			t.Fatalf("want %v, but got %s:%s", e, tiers[i].step, tiers[i].retention)
+		}
+	}
+
+	if tiers, err = parseTiers(time.Minute, time.Hour, ""); err != nil || len(tiers) != 1 {
+		t.Fatalf("expect only the raw tier, but got %v, %v", tiers, err)
+	}
+
+	for _, rollups := range []string{"10m", "x:1h", "10m:x", "30s:1h", "90s:1h", "10m:1h,15m:1h"} {
+		if _, err = parseTiers(time.Minute, time.Hour, rollups); err == nil {
+			t.Fatalf("expect error for %s", rollups)
+		}
+	}
+}
+
+func TestMergeRegions(t *testing.T) {
+	regions := [][]*regionInfo{
+		{
+			newRegionInfo("", "b", 10),
+			newRegionInfo("b", "", 20),
+		},
+		{
+			newRegionInfo("", "a", 10),
+			newRegionInfo("a", "b", 10),
+			newRegionInfo("b", "", 20),
+		},
+	}
+	regions[1][2].ReadKeys = 4
+
+	expected := []*regionInfo{
+		{StartKey: "", EndKey: "a", WrittenBytes: 15},
+		{StartKey: "a", EndKey: "b", WrittenBytes: 15},
+		{StartKey: "b", EndKey: "", WrittenBytes: 40, ReadKeys: 4},
+	}
+
+	merged := mergeRegions(regions)
+	if !reflect.DeepEqual(merged, expected) {
+		t.Fatalf("want %v, but got %v", expected, merged)
+	}
+
+	if merged = mergeRegions(nil); merged != nil {
+		t.Fatalf("expect nil, but got %v", merged)
+	}
+}
+
+func TestTieredStat(t *testing.T) {
+	tiers, err := parseTiers(time.Minute, time.Hour, "10m:24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tier := range tiers {
+		tier.store = newRingStatStore(int(tier.retention/tier.step) + 1)
+	}
+	s := newTieredStat(tiers)
+
+	base := time.Now().Truncate(10 * time.Minute).Add(-30 * time.Minute)
+	for i := 0; i < 25; i++ {
+		st := &Stat{
+			Time:     base.Add(time.Duration(i) * time.Minute),
+			Interval: time.Minute,
+			Regions:  []*regionInfo{newRegionInfo("", "", 1)},
+		}
+		if i >= 10 && i < 20 {
+			st = &Stat{Time: st.Time, Interval: time.Minute, Gap: true}
+		}
+		if err = s.append(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the window within the raw retention is served by the raw tier
+	stats, err := s.rangeStats(base, base.Add(4*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 5 || !stats[0].Time.Equal(base) || stats[0].Interval != time.Minute {
+		t.Fatalf("expect 5 raw stats, but got %v", stats)
+	}
+
+	// the older window is served by the rollups, the last unfinished step
+	// is not rolled up yet.
+	stats, err = s.rangeStats(base.Add(-2*time.Hour), base.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 {
+		t.Fatalf("expect 2 rollups, but got %d", len(stats))
+	}
+	if !stats[0].Time.Equal(base) || stats[0].Interval != 10*time.Minute || stats[0].Regions[0].WrittenBytes != 10 {
+		t.Fatalf("unexpected rollup %v", stats[0])
+	}
+	if !stats[1].Gap {
+		t.Fatalf("expect a gap for the step without regions, but got %v", stats[1])
+	}
+}
+
+func TestTieredStatResume(t *testing.T) {
+	tiers, err := parseTiers(time.Minute, time.Hour, "10m:24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tier := range tiers {
+		tier.store = newRingStatStore(int(tier.retention/tier.step) + 1)
+	}
+
+	// the raw stats saved before restarting
+	base := time.Now().Truncate(10 * time.Minute).Add(-30 * time.Minute)
+	for i := 0; i < 15; i++ {
+		tiers[0].store.append(&Stat{
+			Time:     base.Add(time.Duration(i) * time.Minute),
+			Interval: time.Minute,
+			Regions:  []*regionInfo{newRegionInfo("", "", 1)},
+		})
+	}
+
+	// the steps finished while the process was down are rolled up, the
+	// clock jumps over the steps without any stat
+	s := newTieredStat(tiers)
+	st := &Stat{Time: base.Add(35 * time.Minute), Interval: time.Minute, Regions: []*regionInfo{newRegionInfo("", "", 1)}}
+	if err = s.append(st); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := tiers[1].store.rangeStats(base, base.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 3 {
+		t.Fatalf("expect 3 rollups, but got %v", stats)
+	}
+	if stats[0].Regions[0].WrittenBytes != 10 || stats[1].Regions[0].WrittenBytes != 5 || !stats[2].Gap {
+		t.Fatalf("unexpected rollups %v %v %v", stats[0], stats[1], stats[2])
+	}
+
+	// resume after the latest rollup
+	tiers[1].pending = time.Time{}
+	st = &Stat{Time: base.Add(45 * time.Minute), Interval: time.Minute, Regions: []*regionInfo{newRegionInfo("", "", 1)}}
+	if err = s.append(st); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = tiers[1].store.rangeStats(base, base.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 4 || !stats[3].Time.Equal(base.Add(30*time.Minute)) || stats[3].Regions[0].WrittenBytes != 1 {
+		t.Fatalf("unexpected rollups %v", stats)
+	}
+}
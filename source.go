@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// RegionSource provides the snapshots of all regions in the cluster.
+type RegionSource interface {
+	// Scan returns all the regions sorted by start key.
+	Scan() ([]*regionInfo, error)
+}
+
+// regionsInfo is the regions response of PD.
+type regionsInfo struct {
+	Regions []*regionInfo `json:"regions"`
+}
+
+// pdRegionSource scans the regions from the PD HTTP API.
+type pdRegionSource struct {
+	addr string
+}
+
+func newPDRegionSource(addr string) *pdRegionSource {
+	return &pdRegionSource{addr: addr}
+}
+
+func (s *pdRegionSource) Scan() ([]*regionInfo, error) {
+	return scanRegions(s.addr)
+}
+
+// fileRegionSource replays the regions dumped from PD, like
+// `curl http://pd/pd/api/v1/regions > 0001.json`. Every Scan returns
+// the next file in name order, and starts over after the last one.
+type fileRegionSource struct {
+	sync.Mutex
+
+	files []string
+	next  int
+}
+
+func newFileRegionSource(dir string) (*fileRegionSource, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no region dump found in " + dir)
+	}
+
+	sort.Strings(files)
+	return &fileRegionSource{files: files}, nil
+}
+
+func (s *fileRegionSource) Scan() ([]*regionInfo, error) {
+	s.Lock()
+	file := s.files[s.next]
+	s.next = (s.next + 1) % len(s.files)
+	s.Unlock()
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var info regionsInfo
+	if err = json.Unmarshal(data, &info); err != nil {
+		return nil, err
+	}
+
+	regions := info.Regions
+	sort.Slice(regions, func(i, j int) bool {
+		return regions[i].StartKey < regions[j].StartKey
+	})
+	return regions, nil
+}
+
+// memRegionSource returns the given snapshots in order, and keeps
+// returning the last one after all are consumed.
+type memRegionSource struct {
+	sync.Mutex
+
+	snapshots [][]*regionInfo
+	next      int
+}
+
+func newMemRegionSource(snapshots ...[]*regionInfo) *memRegionSource {
+	return &memRegionSource{snapshots: snapshots}
+}
+
+func (s *memRegionSource) Scan() ([]*regionInfo, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.snapshots) == 0 {
+		return nil, errors.New("no region snapshot")
+	}
+
+	regions := s.snapshots[s.next]
+	if s.next < len(s.snapshots)-1 {
+		s.next++
+	}
+	return regions, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMemRegionSource(t *testing.T) {
+	first := []*regionInfo{
+		newRegionInfo("", encodeTablePrefix(1), 10),
+		newRegionInfo(encodeTablePrefix(1), "", 20),
+	}
+	second := []*regionInfo{
+		newRegionInfo("", "", 30),
+	}
+
+	s := newMemRegionSource(first, second)
+	for _, expected := range [][]*regionInfo{first, second, second} {
+		regions, err := s.Scan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(regions, expected) {
+			t.Fatalf("want %v, but got %v", expected, regions)
+		}
+	}
+
+	if _, err := newMemRegionSource().Scan(); err == nil {
+		t.Fatal("expect error for empty source")
+	}
+}
+
+func TestFileRegionSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keyvisual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dumps := map[string]string{
+		"0001.json": `{"count": 2, "regions": [{"id": 2, "start_key": "74", "end_key": "", "written_bytes": 20}, {"id": 1, "start_key": "", "end_key": "74", "written_bytes": 10}]}`,
+		"0002.json": `{"count": 1, "regions": [{"id": 3, "start_key": "", "end_key": "", "read_bytes": 30}]}`,
+		"README":    `not a dump`,
+	}
+	for name, data := range dumps {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := newFileRegionSource(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]*regionInfo{
+		{
+			{ID: 1, StartKey: "", EndKey: "74", WrittenBytes: 10},
+			{ID: 2, StartKey: "74", EndKey: "", WrittenBytes: 20},
+		},
+		{
+			{ID: 3, StartKey: "", EndKey: "", ReadBytes: 30},
+		},
+	}
+	// replay starts over after the last dump
+	expected = append(expected, expected[0])
+
+	for _, e := range expected {
+		regions, err := s.Scan()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(regions, e) {
+			t.Fatalf("want %v, but got %v", e, regions)
+		}
+	}
+
+	if _, err = newFileRegionSource(filepath.Join(dir, "missing")); err == nil {
+		t.Fatal("expect error for directory without dumps")
+	}
+}
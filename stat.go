@@ -1,6 +1,7 @@
 package main
 
 import (
+	"sort"
 	"sync"
 	"time"
 )
@@ -9,6 +10,17 @@ import (
 type Stat struct {
 	Time    time.Time `json:"time"`
 	Regions []*regionInfo
+	// Interval is the duration the counters of the regions are collected in.
+	Interval time.Duration `json:"interval,omitempty"`
+	// Gap means the regions failed to be scanned at this tick.
+	Gap bool `json:"gap,omitempty"`
+}
+
+// statStore saves the stats of every tick.
+type statStore interface {
+	append(s *Stat) error
+	// rangeStats returns the stats between startTime and endTime.
+	rangeStats(startTime time.Time, endTime time.Time) ([]*Stat, error)
 }
 
 type ringStat struct {
@@ -72,51 +84,116 @@ type RingStat struct {
 	*ringStat
 }
 
-func (r *RingStat) append(regions []*regionInfo) {
-	s := Stat{
-		Time:    time.Now(),
-		Regions: regions,
-	}
+func newRingStatStore(maxSize int) *RingStat {
+	return &RingStat{ringStat: newRingStat(maxSize)}
+}
 
+func (r *RingStat) append(s *Stat) error {
 	r.Lock()
 	defer r.Unlock()
 
-	r.Push(&s)
+	return r.Push(s)
+}
+
+// occupancy returns the number of stats in the ring and its capacity.
+func (r *RingStat) occupancy() (int, int) {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.Len(), r.size
 }
 
-func (r *RingStat) rangeStats(startTime time.Time, endTime time.Time) []*Stat {
+// rangeStats searches the stats by their time, so the slow scans and the
+// skipped ticks don't shift the others.
+func (r *RingStat) rangeStats(startTime time.Time, endTime time.Time) ([]*Stat, error) {
 	r.RLock()
 	defer r.RUnlock()
 
 	size := r.Len()
 	if size == 0 {
-		return nil
+		return nil, nil
+	}
+
+	offset := sort.Search(size, func(i int) bool {
+		return !r.Get(i).Time.Before(startTime)
+	})
+	end := sort.Search(size, func(i int) bool {
+		return r.Get(i).Time.After(endTime)
+	})
+
+	// like the LevelStat, fall back to the latest stat before the end time.
+	if offset >= end {
+		if end == 0 {
+			return nil, nil
+		}
+		offset = end - 1
 	}
 
-	start := r.Get(0)
+	stats := make([]*Stat, 0, end-offset)
+	for i := offset; i < end; i++ {
+		stats = append(stats, r.Get(i))
+	}
 
-	count := int(endTime.Sub(startTime) / *interval)
+	return stats, nil
+}
+
+// fillGaps inserts the gap stats where no stat is saved for more than
+// one interval in [startTime, endTime], including the ticks before the
+// first stat and after the last one, so every column of the heatmap is one
+// interval and the columns reach both ends of the time range.
+func fillGaps(stats []*Stat, startTime time.Time, endTime time.Time, defaultInterval time.Duration) []*Stat {
+	if len(stats) == 0 {
+		return stats
+	}
+	interval := func(s *Stat) time.Duration {
+		if s.Interval == 0 {
+			return defaultInterval
+		}
+		return s.Interval
+	}
+	gap := func(t time.Time, step time.Duration) *Stat {
+		return &Stat{
+			Time:     t,
+			Interval: step,
+			Gap:      true,
+		}
+	}
 
-	offset := int(startTime.Sub(start.Time) / *interval)
-	if offset >= size {
-		offset = size - 1
-	} else if offset < 0 {
-		offset = 0
+	var filled []*Stat
+	first := stats[0]
+	step := interval(first)
+	for t := first.Time.Add(-step); !t.Before(startTime); t = t.Add(-step) {
+		filled = append(filled, gap(t, step))
+	}
+	for i, j := 0, len(filled)-1; i < j; i, j = i+1, j-1 {
+		filled[i], filled[j] = filled[j], filled[i]
 	}
 
-	left := size - offset
-	if count > left {
-		count = left
-	} else if count == 0 {
-		count = 1
+	filled = append(filled, first)
+	for _, s := range stats[1:] {
+		prev := filled[len(filled)-1]
+		step := interval(prev)
+
+		// allow the ticks to be delayed by half an interval
+		for t := prev.Time.Add(step); s.Time.Sub(t) > step/2; t = t.Add(step) {
+			filled = append(filled, gap(t, step))
+		}
+		filled = append(filled, s)
 	}
 
-	stats := make([]*Stat, 0, count)
-	for i := 0; i < count; i++ {
-		stats = append(stats, r.Get(offset+i))
+	// the ticks missed until the end, starting from the start time if the
+	// last stat is before it
+	last := filled[len(filled)-1]
+	step = interval(last)
+	t := last.Time.Add(step)
+	if t.Before(startTime) {
+		t = t.Add((startTime.Sub(t) + step - 1) / step * step)
+	}
+	for ; endTime.Sub(t) > step/2; t = t.Add(step) {
+		filled = append(filled, gap(t, step))
 	}
 
-	return stats
+	return filled
 }
 
-var stat RingStat
+var stat statStore
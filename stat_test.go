@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRingStatRange(t *testing.T) {
+	r := newRingStatStore(4)
+
+	base := time.Unix(1571400000, 0)
+	// the ticks are delayed and the third one is skipped
+	offsets := []time.Duration{0, 70 * time.Second, 190 * time.Second, 240 * time.Second, 300 * time.Second}
+	for _, o := range offsets {
+		r.append(&Stat{Time: base.Add(o)})
+	}
+
+	check := func(start, end time.Duration, expected ...time.Duration) {
+		stats, err := r.rangeStats(base.Add(start), base.Add(end))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stats) != len(expected) {
+			t.Fatalf("want %v, but got %d stats for [%s, %s]", expected, len(stats), start, end)
+		}
+		for i, s := range stats {
+			if !s.Time.Equal(base.Add(expected[i])) {
+				t.Fatalf("want %v, but got %s at %d for [%s, %s]", expected, s.Time.Sub(base), i, start, end)
+			}
+		}
+	}
+
+	// the first one is dropped from the ring
+	check(0, 10*time.Minute, 70*time.Second, 190*time.Second, 240*time.Second, 300*time.Second)
+	check(time.Minute, 3*time.Minute, 70*time.Second)
+	check(3*time.Minute, 4*time.Minute, 190*time.Second, 240*time.Second)
+	// fall back to the latest one before the end
+	check(200*time.Second, 220*time.Second, 190*time.Second)
+	check(10*time.Minute, 20*time.Minute, 300*time.Second)
+	check(-10*time.Minute, -time.Minute)
+}
+
+func TestFillGaps(t *testing.T) {
+	base := time.Unix(1571400000, 0)
+	stats := []*Stat{
+		{Time: base},
+		{Time: base.Add(70 * time.Second)},
+		{Time: base.Add(190 * time.Second)},
+		{Time: base.Add(250 * time.Second), Interval: 10 * time.Minute},
+		{Time: base.Add(1500 * time.Second)},
+	}
+
+	filled := fillGaps(stats, base, base.Add(1500*time.Second), time.Minute)
+
+	expected := []struct {
+		offset time.Duration
+		gap    bool
+	}{
+		{0, false},
+		{70 * time.Second, false},
+		{130 * time.Second, true},
+		{190 * time.Second, false},
+		{250 * time.Second, false},
+		{850 * time.Second, true},
+		{1500 * time.Second, false},
+	}
+	if len(filled) != len(expected) {
+		t.Fatalf("want %d stats, but got %d", len(expected), len(filled))
+	}
+	for i, e := range expected {
+		if !filled[i].Time.Equal(base.Add(e.offset)) || filled[i].Gap != e.gap {
+			t.Fatalf("want %v at %d, but got %s, %v", e, i, filled[i].Time.Sub(base), filled[i].Gap)
+		}
+	}
+}
+
+func TestFillGapsEnds(t *testing.T) {
+	base := time.Unix(1571400000, 0)
+	check := func(stats []*Stat, start time.Duration, end time.Duration, expected []time.Duration, gaps []bool) {
+		filled := fillGaps(stats, base.Add(start), base.Add(end), time.Minute)
+		if len(filled) != len(expected) {
+			t.Fatalf("want %d stats, but got %d", len(expected), len(filled))
+		}
+		for i, offset := range expected {
+			if !filled[i].Time.Equal(base.Add(offset)) || filled[i].Gap != gaps[i] {
+				t.Fatalf("want %s, %v at %d, but got %s, %v", offset, gaps[i], i, filled[i].Time.Sub(base), filled[i].Gap)
+			}
+		}
+	}
+
+	// the ticks missed before the first stat and after the last one
+	check([]*Stat{{Time: base.Add(130 * time.Second)}, {Time: base.Add(190 * time.Second)}}, 0, 400*time.Second,
+		[]time.Duration{10 * time.Second, 70 * time.Second, 130 * time.Second, 190 * time.Second, 250 * time.Second, 310 * time.Second},
+		[]bool{true, true, false, false, true, true})
+	// the latest stat before the start time, the gaps start from the start time
+	check([]*Stat{{Time: base.Add(-30 * time.Minute)}}, 0, 3*time.Minute,
+		[]time.Duration{-30 * time.Minute, 0, time.Minute, 2 * time.Minute},
+		[]bool{false, true, true, true})
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/pingcap/goleveldb/leveldb"
+	"github.com/pingcap/goleveldb/leveldb/util"
+)
+
+// LevelStat saves the stats in goleveldb, keyed by the prefix and the time
+// of the stat, so the stats survive restarts and can cover a much longer
+// time range than the in-memory ring.
+type LevelStat struct {
+	db        *leveldb.DB
+	prefix    []byte
+	retention time.Duration
+}
+
+func newLevelStatStore(db *leveldb.DB, prefix string, retention time.Duration) *LevelStat {
+	return &LevelStat{
+		db:        db,
+		prefix:    []byte(prefix),
+		retention: retention,
+	}
+}
+
+// statKey encodes the time in big endian after the prefix so the keys
+// are in time order.
+func (l *LevelStat) statKey(t time.Time) []byte {
+	key := make([]byte, len(l.prefix)+8)
+	copy(key, l.prefix)
+	binary.BigEndian.PutUint64(key[len(l.prefix):], uint64(t.UnixNano()))
+	return key
+}
+
+func (l *LevelStat) append(s *Stat) error {
+	value, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err = l.db.Put(l.statKey(s.Time), value, nil); err != nil {
+		return err
+	}
+
+	return l.gc(s.Time.Add(-l.retention))
+}
+
+// gc removes all the stats before the time.
+func (l *LevelStat) gc(before time.Time) error {
+	iter := l.db.NewIterator(&util.Range{Start: l.prefix, Limit: l.statKey(before)}, nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+
+	return l.db.Write(batch, nil)
+}
+
+func (l *LevelStat) rangeStats(startTime time.Time, endTime time.Time) ([]*Stat, error) {
+	limit := l.statKey(endTime.Add(1))
+	iter := l.db.NewIterator(&util.Range{Start: l.statKey(startTime), Limit: limit}, nil)
+	defer iter.Release()
+
+	var stats []*Stat
+	for iter.Next() {
+		s, err := decodeStat(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, s)
+	}
+	if err := iter.Error(); err != nil || len(stats) > 0 {
+		return stats, err
+	}
+
+	// like the ring, fall back to the latest stat before the end time.
+	iter = l.db.NewIterator(&util.Range{Start: l.prefix, Limit: limit}, nil)
+	defer iter.Release()
+	if !iter.Last() {
+		return nil, iter.Error()
+	}
+
+	s, err := decodeStat(iter.Value())
+	if err != nil {
+		return nil, err
+	}
+	return []*Stat{s}, nil
+}
+
+func decodeStat(value []byte) (*Stat, error) {
+	s := new(Stat)
+	if err := json.Unmarshal(value, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
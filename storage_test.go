@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pingcap/goleveldb/leveldb"
+)
+
+func TestLevelStat(t *testing.T) {
+	base := time.Unix(1571400000, 0)
+	dir, err := ioutil.TempDir("", "keyvisual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLevelStatStore(db, "1m0s/", 3*time.Minute)
+	// another store sharing the db is not affected
+	other := newLevelStatStore(db, "10m0s/", time.Hour)
+	if err = other.append(&Stat{Time: base, Gap: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		s := &Stat{
+			Time:    base.Add(time.Duration(i) * time.Minute),
+			Regions: []*regionInfo{newRegionInfo("", "", uint64(i))},
+		}
+		if i == 3 {
+			s = &Stat{Time: s.Time, Gap: true}
+		}
+		if err = l.append(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(start, end time.Duration, expected ...uint64) {
+		stats, err := l.rangeStats(base.Add(start), base.Add(end))
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make([]uint64, 0, len(stats))
+		for _, s := range stats {
+			if s.Gap {
+				values = append(values, 100)
+				continue
+			}
+			values = append(values, s.Regions[0].WrittenBytes)
+		}
+		if !reflect.DeepEqual(values, expected) {
+			t.Fatalf("want %v, but got %v for [%s, %s]", expected, values, start, end)
+		}
+	}
+
+	// the stats before the retention are removed
+	check(0, 10*time.Minute, 1, 2, 100, 4)
+	check(2*time.Minute, 3*time.Minute, 2, 100)
+	check(5*time.Minute, 10*time.Minute, 4)
+
+	// the stats survive reopening
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	l = newLevelStatStore(db, "1m0s/", 3*time.Minute)
+	check(0, 2*time.Minute, 1, 2)
+
+	other = newLevelStatStore(db, "10m0s/", time.Hour)
+	stats, err := other.rangeStats(base, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || !stats[0].Gap {
+		t.Fatalf("unexpected stats %v", stats)
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// statBroker passes the new stats to the subscribers.
+type statBroker struct {
+	sync.Mutex
+
+	subs map[chan *Stat]struct{}
+}
+
+func newStatBroker() *statBroker {
+	return &statBroker{subs: make(map[chan *Stat]struct{})}
+}
+
+// subscribe returns the channel of the new stats and the function to stop.
+func (b *statBroker) subscribe() (<-chan *Stat, func()) {
+	ch := make(chan *Stat, 4)
+	b.Lock()
+	b.subs[ch] = struct{}{}
+	b.Unlock()
+
+	return ch, func() {
+		b.Lock()
+		delete(b.subs, ch)
+		b.Unlock()
+	}
+}
+
+// publish sends the stat to all the subscribers, the slow ones miss it
+// instead of blocking updateStat.
+func (b *statBroker) publish(s *Stat) {
+	b.Lock()
+	defer b.Unlock()
+
+	for ch := range b.subs {
+		select {
+		case ch <- s:
+		default:
+		}
+	}
+}
+
+var broker = newStatBroker()
+
+// bucketValues computes the counters of the regions in the buckets of the
+// heatmap, a column for every bucket. Like newHeatmap, the regions are split
+// into the ranges by the splits of the heatmap and their own start keys, and
+// the ranges are summed up into the buckets, so the column is the same as
+// the one of the heatmap built with the stat.
+func bucketValues(h Heatmap, regions []*regionInfo, metrics []*metric) map[string][][]uint64 {
+	buckets := make([]RangeBuilder, len(h.Ranges))
+	for i, r := range h.Ranges {
+		buckets[i] = RangeBuilder{Start: r.StartKey.Desc, End: r.EndKey.Desc}
+	}
+	var start, end string
+	if len(buckets) > 0 {
+		start, end = buckets[0].Start, buckets[len(buckets)-1].End
+		startIndex, endIndex := rangeRegionIndices(start, end, regions)
+		regions = regions[startIndex:endIndex]
+	}
+	if len(regions) == 0 {
+		values := make([][]uint64, len(buckets))
+		for i := range values {
+			values[i] = make([]uint64, 1)
+		}
+		counterValues := make(map[string][][]uint64)
+		for _, m := range metrics {
+			for _, name := range m.counters {
+				counterValues[name] = values
+			}
+		}
+		return counterValues
+	}
+
+	first, last := regions[0].StartKey, regions[len(regions)-1].EndKey
+	keySet := make(map[string]struct{})
+	for _, key := range h.splits {
+		keySet[key] = struct{}{}
+	}
+	for _, b := range buckets {
+		keySet[b.Start] = struct{}{}
+	}
+	if end != "" {
+		keySet[end] = struct{}{}
+	}
+	for _, r := range regions {
+		keySet[r.StartKey] = struct{}{}
+	}
+	keys := make([]string, 0, len(keySet))
+	for key := range keySet {
+		if key >= first && (last == "" || key < last) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	ranges := make([]RangeBuilder, len(keys))
+	for i, key := range keys {
+		ranges[i] = RangeBuilder{Start: key, End: last}
+		if i+1 < len(keys) {
+			ranges[i].End = keys[i+1]
+		}
+	}
+
+	// only the ranges in the buckets are summed up
+	from := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].Start >= start
+	})
+	to := len(ranges)
+	if end != "" {
+		to = sort.Search(len(ranges), func(i int) bool {
+			return ranges[i].Start >= end
+		})
+	}
+
+	counterValues := calCounterValues(ranges, [][]*regionInfo{regions}, metrics)
+	for name, values := range counterValues {
+		counterValues[name] = regroupValues(ranges[from:to], values[from:to], buckets)
+	}
+	return counterValues
+}
+
+// columnValues is the new column of a heatmap.
+type columnValues struct {
+	Labels  []string            `json:"labels"`
+	Values  []uint64            `json:"values"`
+	Metrics map[string][]uint64 `json:"metrics,omitempty"`
+}
+
+type outColumn struct {
+	Time     time.Time      `json:"time"`
+	Gap      bool           `json:"gap,omitempty"`
+	Heatmaps []columnValues `json:"heatmaps,omitempty"`
+}
+
+// newColumn computes the column of the stat in the buckets of every heatmap.
+func newColumn(s *Stat, heatmaps []Heatmap, metrics []*metric, loc *time.Location) outColumn {
+	col := outColumn{Time: s.Time.In(loc), Gap: s.Gap}
+	if s.Gap {
+		return col
+	}
+
+	col.Heatmaps = make([]columnValues, len(heatmaps))
+	for i, h := range heatmaps {
+		regions := s.Regions
+		if h.moveRegions != nil {
+			regions = h.moveRegions(regions)
+		}
+		counterValues := bucketValues(h, regions, metrics)
+		derive := func(m *metric) []uint64 {
+			values := make([]uint64, len(h.Ranges))
+			for j, v := range m.deriveValues(counterValues) {
+				values[j] = v[0]
+			}
+			return values
+		}
+
+		col.Heatmaps[i] = columnValues{Labels: h.Labels, Values: derive(metrics[0])}
+		if len(metrics) > 1 {
+			col.Heatmaps[i].Metrics = make(map[string][]uint64, len(metrics))
+			for _, m := range metrics {
+				col.Heatmaps[i].Metrics[m.name] = derive(m)
+			}
+		}
+	}
+	return col
+}
+
+// pingInterval is the interval of the comments sent to keep the idle stream
+// from being dropped by the proxies.
+var pingInterval = 15 * time.Second
+
+func writeEvent(w http.ResponseWriter, event string, v interface{}) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	w.(http.Flusher).Flush()
+}
+
+// streamHandler streams the heatmaps as the server-sent events. It takes
+// the same query as /heatmaps and sends the heatmaps event of the window
+// first, then a column event with the values in the same buckets whenever
+// a new stat is saved. The heatmaps event is sent with the first stat if
+// there is none yet. The columns are not merged, so step and max_columns
+// are rejected.
+func streamHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := w.(http.Flusher); !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	req, err := parseHeatmapRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.step > 0 || req.maxColumns > 0 {
+		http.Error(w, "step and max_columns are not supported by the stream", http.StatusBadRequest)
+		return
+	}
+	sc, err := parseHeatmapScope(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// subscribe first to not miss the stats saved while loading
+	stats, cancel := broker.subscribe()
+	defer cancel()
+
+	cols, err := req.loadColumns()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	var heatmaps []Heatmap
+	var last time.Time
+	if cols != nil {
+		out := req.output(cols, sc.build(req, cols))
+		heatmaps = out.Heatmaps
+		writeEvent(w, "heatmaps", out)
+		last = cols.times[len(cols.times)-1]
+	} else {
+		w.(http.Flusher).Flush()
+	}
+
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ping.C:
+			fmt.Fprint(w, ": ping\n\n")
+			w.(http.Flusher).Flush()
+		case s := <-stats:
+			if !s.Time.After(last) {
+				continue
+			}
+			last = s.Time
+
+			if heatmaps == nil {
+				if s.Gap {
+					continue
+				}
+				unit := s.Interval
+				if unit == 0 {
+					unit = *interval
+				}
+				cols := &statColumns{
+					regions: [][]*regionInfo{s.Regions},
+					times:   []time.Time{s.Time},
+					isGap:   []bool{false},
+					unit:    unit,
+				}
+				heatmaps = sc.build(req, cols)
+				writeEvent(w, "heatmaps", req.output(cols, heatmaps))
+				continue
+			}
+			writeEvent(w, "column", newColumn(s, heatmaps, req.metrics, req.loc))
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
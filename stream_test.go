@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamHandler(t *testing.T) {
+	old := stat
+	defer func() { stat = old }()
+	s := newRingStatStore(10)
+	stat = s
+
+	now := time.Now()
+	s.append(&Stat{
+		Time: now.Add(-time.Second),
+		Regions: []*regionInfo{
+			newRegionInfo("", GenTablePrefix(1), 10),
+			newRegionInfo(GenTablePrefix(1), GenTablePrefix(2), 20),
+			newRegionInfo(GenTablePrefix(2), "", 30),
+		},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "?scope=cluster&start=-1m&N=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	next := func(v interface{}) string {
+		var event string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				if err = json.Unmarshal([]byte(line[len("data: "):]), v); err != nil {
+					t.Fatal(err)
+				}
+			case line == "":
+				return event
+			}
+		}
+	}
+
+	var out outStat
+	if event := next(&out); event != "heatmaps" || len(out.Heatmaps) != 1 || len(out.Heatmaps[0].Ranges) != 3 {
+		t.Fatalf("unexpected event %s %v", event, out)
+	}
+
+	// the new region is split into the buckets it covers
+	broker.publish(&Stat{
+		Time: now,
+		Regions: []*regionInfo{
+			newRegionInfo("", GenTablePrefix(2), 100),
+			newRegionInfo(GenTablePrefix(2), "", 7),
+		},
+	})
+	var col outColumn
+	if event := next(&col); event != "column" || len(col.Heatmaps) != 1 {
+		t.Fatalf("unexpected event %s %v", event, col)
+	}
+	if !reflect.DeepEqual(col.Heatmaps[0].Values, []uint64{50, 50, 7}) {
+		t.Fatalf("unexpected values %v", col.Heatmaps[0].Values)
+	}
+}
+
+func TestStreamPing(t *testing.T) {
+	old := stat
+	defer func() { stat = old }()
+	stat = newRingStatStore(10)
+
+	oldInterval := pingInterval
+	defer func() { pingInterval = oldInterval }()
+	pingInterval = 10 * time.Millisecond
+
+	server := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?step=10m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expect bad request for step, but got %d", resp.StatusCode)
+	}
+
+	resp, err = http.Get(server.URL + "?start=-1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil || line != ": ping\n" {
+		t.Fatalf("expect ping, but got %q %v", line, err)
+	}
+}
+
+func TestStreamColumnSameAsHeatmap(t *testing.T) {
+	old := stat
+	defer func() { stat = old }()
+	s := newRingStatStore(10)
+	stat = s
+
+	now := time.Now()
+	s.append(&Stat{
+		Time: now.Add(-time.Second),
+		Regions: []*regionInfo{
+			newRegionInfo("", GenTablePrefix(1), 1),
+			newRegionInfo(GenTablePrefix(1), GenTablePrefix(2), 1),
+			newRegionInfo(GenTablePrefix(2), GenTablePrefix(3), 1),
+			newRegionInfo(GenTablePrefix(3), "", 1),
+		},
+	})
+
+	server := httptest.NewServer(http.HandlerFunc(streamHandler))
+	defer server.Close()
+	query := "?scope=cluster&start=-1m&N=2&squash=step"
+	resp, err := http.Get(server.URL + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	reader := bufio.NewReader(resp.Body)
+	next := func(v interface{}) {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			line = strings.TrimSpace(line)
+			if strings.HasPrefix(line, "data: ") {
+				if err = json.Unmarshal([]byte(line[len("data: "):]), v); err != nil {
+					t.Fatal(err)
+				}
+			} else if line == "" {
+				return
+			}
+		}
+	}
+	var out outStat
+	next(&out)
+
+	// the new region covers 3 ranges, 2 of them in the first bucket
+	st := &Stat{
+		Time: now,
+		Regions: []*regionInfo{
+			newRegionInfo("", GenTablePrefix(3), 90),
+			newRegionInfo(GenTablePrefix(3), "", 0),
+		},
+	}
+	s.append(st)
+	broker.publish(st)
+	var col outColumn
+	next(&col)
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/heatmaps"+query, nil))
+	if err = json.Unmarshal(w.Body.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	var last []uint64
+	for _, values := range out.Heatmaps[0].Values {
+		last = append(last, values[len(values)-1])
+	}
+	if !reflect.DeepEqual(last, []uint64{60, 30}) || !reflect.DeepEqual(col.Heatmaps[0].Values, last) {
+		t.Fatalf("want %v, but got %v", last, col.Heatmaps[0].Values)
+	}
+}
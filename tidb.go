@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"reflect"
 	"sort"
 	"sync"
+	"time"
+
+	"github.com/pingcap/tidb/mysql"
+	"github.com/pingcap/tidb/types"
 )
 
 // Table saves the info of a table
@@ -16,12 +22,47 @@ type Table struct {
 	ID   int64
 
 	Indices map[int64]string
+	// IndexColumns are the columns of every index to decode the index keys.
+	IndexColumns map[int64][]Column
+	// Handle is the integer primary key saved as the handle of the records,
+	// empty if the handle is the hidden row ID.
+	Handle string
+	// IsCommonHandle is set if the handle of the records is the clustered
+	// primary key which is not a single integer, and CommonHandle are its
+	// columns, nil if they are unknown.
+	IsCommonHandle bool
+	CommonHandle   []Column
+	// Partitions are in the order of definition, the records and indices
+	// of a partitioned table are saved under the IDs of its partitions.
+	Partitions []Partition
+}
+
+// Partition is a partition of a table with its own physical table ID.
+type Partition struct {
+	ID   int64
+	Name string
 }
 
 func (t *Table) String() string {
 	return fmt.Sprintf("%s.%s", t.DB, t.Name)
 }
 
+// partitions returns the partitions of the table, or the table itself as
+// the only one if it is not partitioned.
+func (t *Table) partitions() []Partition {
+	if len(t.Partitions) == 0 {
+		return []Partition{{ID: t.ID}}
+	}
+	return t.Partitions
+}
+
+func (t *Table) partitionName(p Partition) string {
+	if p.Name == "" {
+		return t.Name
+	}
+	return fmt.Sprintf("%s.%s", t.Name, p.Name)
+}
+
 // TableSlice is the slice of tables
 type TableSlice []*Table
 
@@ -39,46 +80,355 @@ func (s TableSlice) Less(i, j int) bool {
 	return s[i].ID < s[j].ID
 }
 
-// id -> map
-var tables = sync.Map{}
+// tableVersion is the table valid in [from, to), to is zero if the table
+// is still there. from is zero for the tables found by the first load, as
+// the stats before are unknown.
+type tableVersion struct {
+	table *Table
+	dbID  int64
+	from  time.Time
+	to    time.Time
+}
 
-func loadTables() []*Table {
-	tbls := make([]*Table, 0, 1024)
+func (v *tableVersion) liveIn(start time.Time, end time.Time) bool {
+	return !v.from.After(end) && (v.to.IsZero() || v.to.After(start))
+}
 
-	tables.Range(func(_key, value interface{}) bool {
-		tbl := value.(*Table)
-		tbls = append(tbls, tbl)
-		return true
-	})
+func sameTable(a *Table, b *Table) bool {
+	return a.DB == b.DB && a.Name == b.Name && a.Handle == b.Handle &&
+		a.IsCommonHandle == b.IsCommonHandle && reflect.DeepEqual(a.CommonHandle, b.CommonHandle) &&
+		reflect.DeepEqual(a.Indices, b.Indices) &&
+		reflect.DeepEqual(a.IndexColumns, b.IndexColumns) &&
+		reflect.DeepEqual(a.Partitions, b.Partitions)
+}
+
+// tableHistory keeps every version of the tables, so the old stats are
+// labelled with the schema at that time.
+type tableHistory struct {
+	sync.RWMutex
+
+	// id -> versions in time order
+	versions map[int64][]*tableVersion
+	// partition id -> table id
+	partitions map[int64]int64
+	loaded     bool
+	// retention is how long to keep the dropped versions, forever if 0.
+	retention time.Duration
+}
+
+func newTableHistory() *tableHistory {
+	return &tableHistory{
+		versions:   make(map[int64][]*tableVersion),
+		partitions: make(map[int64]int64),
+	}
+}
+
+func (h *tableHistory) current(id int64) *tableVersion {
+	vs := h.versions[id]
+	if len(vs) == 0 || !vs[len(vs)-1].to.IsZero() {
+		return nil
+	}
+	return vs[len(vs)-1]
+}
+
+// update saves the tables loaded from the database at now, the tables
+// missing from the database are dropped.
+func (h *tableHistory) update(dbID int64, tbls []*Table, now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+
+	from := now
+	if !h.loaded {
+		from = time.Time{}
+	}
+
+	found := make(map[int64]struct{}, len(tbls))
+	for _, t := range tbls {
+		found[t.ID] = struct{}{}
+		cur := h.current(t.ID)
+		if cur != nil && cur.dbID == dbID && sameTable(cur.table, t) {
+			continue
+		}
+		if cur != nil {
+			cur.to = now
+		}
+		h.versions[t.ID] = append(h.versions[t.ID], &tableVersion{table: t, dbID: dbID, from: from})
+		for _, p := range t.Partitions {
+			h.partitions[p.ID] = t.ID
+		}
+	}
+
+	for id := range h.versions {
+		if _, ok := found[id]; ok {
+			continue
+		}
+		if cur := h.current(id); cur != nil && cur.dbID == dbID {
+			cur.to = now
+		}
+	}
+}
+
+// keepDBs drops the tables of the databases not in dbIDs, and the versions
+// out of the retention.
+func (h *tableHistory) keepDBs(dbIDs map[int64]struct{}, now time.Time) {
+	h.Lock()
+	h.loaded = true
+	for id := range h.versions {
+		if cur := h.current(id); cur != nil {
+			if _, ok := dbIDs[cur.dbID]; !ok {
+				cur.to = now
+			}
+		}
+	}
+	h.Unlock()
+
+	h.expire(now)
+}
+
+// expire drops the versions out of the retention.
+func (h *tableHistory) expire(now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.retention <= 0 {
+		return
+	}
+	for id, vs := range h.versions {
+		i := 0
+		for i < len(vs) && !vs[i].to.IsZero() && now.Sub(vs[i].to) > h.retention {
+			i++
+		}
+		if i == len(vs) {
+			delete(h.versions, id)
+			for _, p := range vs[len(vs)-1].table.Partitions {
+				delete(h.partitions, p.ID)
+			}
+		} else if i > 0 {
+			h.versions[id] = vs[i:]
+		}
+	}
+}
+
+// at returns the latest version of the table live in [start, end], or of the
+// table the partition belongs to.
+func (h *tableHistory) at(id int64, start time.Time, end time.Time) (*Table, bool) {
+	h.RLock()
+	defer h.RUnlock()
+
+	if tid, ok := h.partitions[id]; ok {
+		id = tid
+	}
+	vs := h.versions[id]
+	for i := len(vs) - 1; i >= 0; i-- {
+		if vs[i].liveIn(start, end) {
+			return vs[i].table, true
+		}
+	}
+	return nil, false
+}
+
+// list returns the latest versions of the tables live in [start, end].
+func (h *tableHistory) list(start time.Time, end time.Time) []*Table {
+	h.RLock()
+	ids := make([]int64, 0, len(h.versions))
+	for id := range h.versions {
+		ids = append(ids, id)
+	}
+	h.RUnlock()
+
+	tbls := make([]*Table, 0, len(ids))
+	for _, id := range ids {
+		if t, ok := h.at(id, start, end); ok {
+			tbls = append(tbls, t)
+		}
+	}
 
 	sort.Sort(TableSlice(tbls))
 	return tbls
 }
 
-func readBody(addr string, uri string, v interface{}) {
-	resp, err := http.Get(fmt.Sprintf("%s/%s", addr, uri))
-	perr(err)
+var tables = newTableHistory()
+
+// loadTables returns the tables now.
+func loadTables() []*Table {
+	now := time.Now()
+	return tables.list(now, now)
+}
+
+// loadTablesAt returns the tables live in [start, end], the latest version
+// is used if a table is changed in it.
+func loadTablesAt(start time.Time, end time.Time) []*Table {
+	return tables.list(start, end)
+}
+
+var httpClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetchError is returned when requesting PD or TiDB fails.
+type fetchError struct {
+	URL string
+	Err error
+}
+
+func (e *fetchError) Error() string {
+	return fmt.Sprintf("fetch %s: %v", e.URL, e.Err)
+}
+
+func (e *fetchError) Unwrap() error {
+	return e.Err
+}
+
+func readBody(addr string, uri string, v interface{}) error {
+	u := fmt.Sprintf("%s/%s", addr, uri)
+	resp, err := httpClient.Get(u)
+	if err != nil {
+		return &fetchError{URL: u, Err: err}
+	}
+	defer resp.Body.Close()
+
 	r, err := ioutil.ReadAll(resp.Body)
-	perr(err)
-	resp.Body.Close()
+	if err != nil {
+		return &fetchError{URL: u, Err: err}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &fetchError{URL: u, Err: fmt.Errorf("%s: %s", resp.Status, r)}
+	}
 
-	err = json.Unmarshal([]byte(r), v)
-	perr(err)
+	if err = json.Unmarshal(r, v); err != nil {
+		return &fetchError{URL: u, Err: err}
+	}
+	return nil
 }
 
-func updateTables() {
-	type dbStruct struct {
-		Name struct {
-			O string `json:"O"`
-			L string `json:"L"`
-		} `json:"db_name"`
-		State int `json:"state"`
+// retry calls f until it succeeds or n attempts are made, doubling
+// the backoff after every failure. f is always called at least once.
+func retry(ctx context.Context, n int, backoff time.Duration, f func() error) error {
+	if n < 1 {
+		n = 1
 	}
+	var err error
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff):
+				backoff *= 2
+			case <-ctx.Done():
+				return err
+			}
+		}
 
-	dbInfo := make([]dbStruct, 0)
-	readBody(*tidbAddr, "schema", &dbInfo)
+		if err = f(); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// schemaCache remembers the schema version the tables are loaded at, so
+// only the databases changed by the later DDL jobs are loaded again.
+type schemaCache struct {
+	sync.Mutex
+
+	version      int64
+	loadedAt     time.Time
+	loadDuration time.Duration
+}
+
+func (c *schemaCache) get() (int64, time.Time, time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.version, c.loadedAt, c.loadDuration
+}
+
+func (c *schemaCache) set(version int64, loadedAt time.Time, loadDuration time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.version, c.loadedAt, c.loadDuration = version, loadedAt, loadDuration
+}
+
+var schema schemaCache
 
-	// TODO: check schema version to avoid duplicated loading
+// ddlHistoryLimit is the number of the latest DDL jobs to check, all the
+// databases are loaded again if more jobs are done in an interval.
+const ddlHistoryLimit = 256
+
+type ddlJob struct {
+	ID         int64 `json:"id"`
+	SchemaID   int64 `json:"schema_id"`
+	BinlogInfo *struct {
+		SchemaVersion int64 `json:"SchemaVersion"`
+	} `json:"binlog"`
+}
+
+func (j *ddlJob) schemaVersion() int64 {
+	if j.BinlogInfo == nil {
+		return 0
+	}
+	return j.BinlogInfo.SchemaVersion
+}
+
+type dbStruct struct {
+	ID   int64 `json:"id"`
+	Name struct {
+		O string `json:"O"`
+		L string `json:"L"`
+	} `json:"db_name"`
+	State int `json:"state"`
+}
+
+// changedSchemas returns the latest schema version and the IDs of the
+// databases changed after the cached version, nil means all of them. The
+// error is returned only if the tables are loaded, they are kept until the
+// DDL history is available again.
+func changedSchemas(version int64, loaded bool) (int64, map[int64]struct{}, error) {
+	var jobs []ddlJob
+	if err := readBody(*tidbAddr, fmt.Sprintf("ddl/history?limit=%d", ddlHistoryLimit), &jobs); err != nil {
+		if loaded {
+			return version, nil, err
+		}
+		return version, nil, nil
+	}
+	// the jobs are not always in the order of the schema versions
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].schemaVersion() < jobs[j].schemaVersion()
+	})
+
+	latest := version
+	changed := make(map[int64]struct{})
+	for _, job := range jobs {
+		v := job.schemaVersion()
+		if v > latest {
+			latest = v
+		}
+		if v > version {
+			changed[job.SchemaID] = struct{}{}
+		}
+	}
+
+	// some jobs may be missed out of the limit
+	if !loaded || len(jobs) >= ddlHistoryLimit && jobs[0].schemaVersion() > version {
+		return latest, nil, nil
+	}
+	return latest, changed, nil
+}
+
+func updateTables() error {
+	start := time.Now()
+	version, loadedAt, _ := schema.get()
+	latest, changed, err := changedSchemas(version, !loadedAt.IsZero())
+	if err != nil {
+		return fmt.Errorf("read the DDL history failed: %v", err)
+	}
+	if changed != nil && len(changed) == 0 {
+		tables.expire(time.Now())
+		return nil
+	}
+
+	dbInfo := make([]dbStruct, 0)
+	if err := readBody(*tidbAddr, "schema", &dbInfo); err != nil {
+		return err
+	}
 
 	type tblStruct struct {
 		ID   int64 `json:"id"`
@@ -86,35 +436,112 @@ func updateTables() {
 			O string `json:"O"`
 			L string `json:"L"`
 		} `json:"name"`
-		Indices []struct {
+		Columns []struct {
+			Name struct {
+				O string `json:"O"`
+				L string `json:"L"`
+			} `json:"name"`
+			Type types.FieldType `json:"type"`
+		} `json:"cols"`
+		PKIsHandle     bool `json:"pk_is_handle"`
+		IsCommonHandle bool `json:"is_common_handle"`
+		Indices        []struct {
 			ID   int64 `json:"id"`
 			Name struct {
 				O string `json:"O"`
 				L string `json:"L"`
 			} `json:"idx_name"`
+			Primary bool `json:"is_primary"`
+			Columns []struct {
+				Offset int `json:"offset"`
+			} `json:"idx_cols"`
 		} `json:"index_info"`
+		Partition *struct {
+			Definitions []struct {
+				ID   int64 `json:"id"`
+				Name struct {
+					O string `json:"O"`
+					L string `json:"L"`
+				} `json:"name"`
+			} `json:"definitions"`
+		} `json:"partition"`
 	}
+	now := time.Now()
+	dbIDs := make(map[int64]struct{}, len(dbInfo))
 	tblInfos := make([]tblStruct, 0)
 	for _, info := range dbInfo {
 		if info.State == 0 {
 			continue
 		}
+		dbIDs[info.ID] = struct{}{}
+		if changed != nil {
+			if _, ok := changed[info.ID]; !ok {
+				continue
+			}
+		}
 
-		readBody(*tidbAddr, fmt.Sprintf("schema/%s", info.Name.O), &tblInfos)
+		if err := readBody(*tidbAddr, fmt.Sprintf("schema/%s", info.Name.O), &tblInfos); err != nil {
+			return err
+		}
 
+		tbls := make([]*Table, 0, len(tblInfos))
 		for _, tbl := range tblInfos {
 			indices := make(map[int64]string, len(tbl.Indices))
+			indexColumns := make(map[int64][]Column, len(tbl.Indices))
+			var commonHandle []Column
 			for _, idx := range tbl.Indices {
+				cols := make([]Column, 0, len(idx.Columns))
+				for _, col := range idx.Columns {
+					if col.Offset < 0 || col.Offset >= len(tbl.Columns) {
+						// the values can not be typed without all the columns
+						cols = nil
+						break
+					}
+					c := tbl.Columns[col.Offset]
+					cols = append(cols, Column{Name: c.Name.O, Type: c.Type})
+				}
+
+				// the clustered primary key has no index keys, it is the handle
+				if tbl.IsCommonHandle && idx.Primary {
+					commonHandle = cols
+					continue
+				}
 				indices[idx.ID] = idx.Name.O
+				if cols != nil {
+					indexColumns[idx.ID] = cols
+				}
 			}
-			table := &Table{
-				ID:      tbl.ID,
-				DB:      info.Name.O,
-				Name:    tbl.Name.O,
-				Indices: indices,
+			var handle string
+			if tbl.PKIsHandle {
+				for _, c := range tbl.Columns {
+					if mysql.HasPriKeyFlag(c.Type.Flag) {
+						handle = c.Name.O
+						break
+					}
+				}
 			}
-
-			tables.Store(tbl.ID, table)
+			var partitions []Partition
+			if tbl.Partition != nil {
+				for _, def := range tbl.Partition.Definitions {
+					partitions = append(partitions, Partition{ID: def.ID, Name: def.Name.O})
+				}
+			}
+			tbls = append(tbls, &Table{
+				ID:             tbl.ID,
+				DB:             info.Name.O,
+				Name:           tbl.Name.O,
+				Indices:        indices,
+				IndexColumns:   indexColumns,
+				Handle:         handle,
+				IsCommonHandle: tbl.IsCommonHandle,
+				CommonHandle:   commonHandle,
+				Partitions:     partitions,
+			})
 		}
+		tables.update(info.ID, tbls, now)
 	}
+	tables.keepDBs(dbIDs, now)
+
+	schema.set(latest, time.Now(), time.Since(start))
+	return nil
 }
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadBody(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.Write([]byte(`{"regions": [{"id": 1}]}`))
+		case "/bad":
+			w.Write([]byte(`{"regions": `))
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer s.Close()
+
+	var info regionsInfo
+	if err := readBody(s.URL, "ok", &info); err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Regions) != 1 || info.Regions[0].ID != 1 {
+		t.Fatalf("unexpected regions %v", info.Regions)
+	}
+
+	for _, uri := range []string{"bad", "down"} {
+		err := readBody(s.URL, uri, &info)
+		var fe *fetchError
+		if !errors.As(err, &fe) {
+			t.Fatalf("expect fetch error for %s, but got %v", uri, err)
+		}
+	}
+
+	// the server is gone
+	s.Close()
+	if err := readBody(s.URL, "ok", &info); err == nil {
+		t.Fatal("expect error for closed server")
+	}
+}
+
+func TestRetry(t *testing.T) {
+	count := 0
+	err := retry(context.Background(), 3, time.Millisecond, func() error {
+		count++
+		if count < 3 {
+			return errors.New("fail")
+		}
+		return nil
+	})
+	if err != nil || count != 3 {
+		t.Fatalf("expect success after 3 attempts, but got %v after %d", err, count)
+	}
+
+	count = 0
+	err = retry(context.Background(), 2, time.Millisecond, func() error {
+		count++
+		return errors.New("fail")
+	})
+	if err == nil || count != 2 {
+		t.Fatalf("expect failure after 2 attempts, but got %v after %d", err, count)
+	}
+
+	// at least one attempt
+	count = 0
+	retry(context.Background(), 0, time.Millisecond, func() error {
+		count++
+		return nil
+	})
+	if count != 1 {
+		t.Fatalf("expect 1 attempt, but got %d", count)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	count = 0
+	retry(ctx, 3, time.Hour, func() error {
+		count++
+		return errors.New("fail")
+	})
+	if count != 1 {
+		t.Fatalf("expect no retry after cancel, but got %d attempts", count)
+	}
+}
+
+func TestUpdateTables(t *testing.T) {
+	jobs := `[]`
+	requests := make(map[string]int)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/ddl/history":
+			w.Write([]byte(jobs))
+		case "/schema":
+			w.Write([]byte(`[{"id": 1, "db_name": {"O": "db1"}, "state": 5}, {"id": 2, "db_name": {"O": "db2"}, "state": 5}]`))
+		case "/schema/db1":
+			w.Write([]byte(`[{"id": 31, "name": {"O": "t1"}, "pk_is_handle": true,
+				"cols": [{"name": {"O": "id"}, "type": {"Tp": 8, "Flag": 3}}, {"name": {"O": "a"}, "type": {"Tp": 15}}],
+				"index_info": [{"id": 1, "idx_name": {"O": "idx"}, "idx_cols": [{"offset": 1}]},
+					{"id": 2, "idx_name": {"O": "idx2"}, "idx_cols": [{"offset": 1}, {"offset": 5}]}]}]`))
+		case "/schema/db2":
+			w.Write([]byte(`[{"id": 32, "name": {"O": "t2"}, "is_common_handle": true,
+				"cols": [{"name": {"O": "k"}, "type": {"Tp": 15}}],
+				"index_info": [{"id": 1, "idx_name": {"O": "PRIMARY"}, "is_primary": true, "idx_cols": [{"offset": 0}]}],
+				"partition": {"definitions": [{"id": 33, "name": {"O": "p0"}}]}}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer s.Close()
+
+	oldAddr := *tidbAddr
+	*tidbAddr = s.URL
+	schema.set(0, time.Time{}, 0)
+	oldTables := tables
+	tables = newTableHistory()
+	defer func() {
+		*tidbAddr = oldAddr
+		schema.set(0, time.Time{}, 0)
+		tables = oldTables
+	}()
+
+	update := func(expected map[string]int, wantErr bool) {
+		for k := range requests {
+			delete(requests, k)
+		}
+		if err := updateTables(); (err != nil) != wantErr {
+			t.Fatalf("want error %v, but got %v", wantErr, err)
+		}
+		for _, path := range []string{"/ddl/history", "/schema", "/schema/db1", "/schema/db2"} {
+			if requests[path] != expected[path] {
+				t.Fatalf("want %v, but got %v", expected, requests)
+			}
+		}
+	}
+
+	// load all at first
+	jobs = `[{"id": 10, "schema_id": 1, "binlog": {"SchemaVersion": 20}}]`
+	update(map[string]int{"/ddl/history": 1, "/schema": 1, "/schema/db1": 1, "/schema/db2": 1}, false)
+	now := time.Now()
+	if v, ok := tables.at(31, now, now); !ok || v.Indices[1] != "idx" || v.Handle != "id" ||
+		len(v.IndexColumns[1]) != 1 || v.IndexColumns[1][0].Name != "a" {
+		t.Fatalf("unexpected table %v", v)
+	}
+	// the index with an unknown column is not typed
+	if v, _ := tables.at(31, now, now); v.Indices[2] != "idx2" || v.IndexColumns[2] != nil {
+		t.Fatalf("unexpected table %v", v)
+	}
+	if v, ok := tables.at(32, now, now); !ok || !reflect.DeepEqual(v.Partitions, []Partition{{ID: 33, Name: "p0"}}) ||
+		!v.IsCommonHandle || len(v.CommonHandle) != 1 || v.CommonHandle[0].Name != "k" {
+		t.Fatalf("unexpected table %v", v)
+	}
+	// the clustered primary key is the handle instead of an index
+	if v, _ := tables.at(32, now, now); len(v.Indices) != 0 || len(v.IndexColumns) != 0 {
+		t.Fatalf("unexpected table %v", v)
+	}
+	if version, _, _ := schema.get(); version != 20 {
+		t.Fatalf("want schema version 20, but got %d", version)
+	}
+
+	// nothing changed, but the dropped tables out of the retention are removed
+	dropped := now.Add(-2 * time.Hour)
+	tables.update(9, []*Table{{ID: 99, DB: "db9", Name: "t9"}}, dropped.Add(-time.Minute))
+	tables.keepDBs(map[int64]struct{}{1: {}, 2: {}}, dropped)
+	if _, ok := tables.at(99, dropped.Add(-time.Second), dropped.Add(-time.Second)); !ok {
+		t.Fatal("the dropped table is not found")
+	}
+	tables.retention = time.Hour
+	update(map[string]int{"/ddl/history": 1}, false)
+	if _, ok := tables.at(99, dropped.Add(-time.Second), dropped.Add(-time.Second)); ok {
+		t.Fatal("the dropped table is not removed")
+	}
+
+	// only db2 changed
+	jobs = `[{"id": 10, "schema_id": 1, "binlog": {"SchemaVersion": 20}}, {"id": 11, "schema_id": 2, "binlog": {"SchemaVersion": 21}}]`
+	update(map[string]int{"/ddl/history": 1, "/schema": 1, "/schema/db2": 1}, false)
+	if version, _, _ := schema.get(); version != 21 {
+		t.Fatalf("want schema version 21, but got %d", version)
+	}
+
+	// the jobs newest first, the oldest one is not newer than the cached
+	// version so none is missed
+	var history []string
+	for v := 21 + ddlHistoryLimit - 1; v >= 21; v-- {
+		history = append(history, fmt.Sprintf(`{"id": %d, "schema_id": 2, "binlog": {"SchemaVersion": %d}}`, v, v))
+	}
+	jobs = "[" + strings.Join(history, ",") + "]"
+	update(map[string]int{"/ddl/history": 1, "/schema": 1, "/schema/db2": 1}, false)
+
+	// keep the loaded tables without the DDL history
+	jobs = `{`
+	update(map[string]int{"/ddl/history": 1}, true)
+	if version, _, _ := schema.get(); version != 21+ddlHistoryLimit-1 {
+		t.Fatalf("want schema version %d, but got %d", 21+ddlHistoryLimit-1, version)
+	}
+}
+
+func TestTableHistory(t *testing.T) {
+	h := newTableHistory()
+	h.retention = time.Hour
+
+	t0 := time.Now()
+	h.update(1, []*Table{{ID: 1, DB: "db", Name: "a"}, {ID: 2, DB: "db", Name: "b"}}, t0)
+	h.update(2, []*Table{{ID: 3, DB: "db2", Name: "c"}}, t0)
+	h.keepDBs(map[int64]struct{}{1: {}, 2: {}}, t0)
+
+	// rename a, drop b and db2
+	t1 := t0.Add(time.Minute)
+	h.update(1, []*Table{{ID: 1, DB: "db", Name: "a2"}}, t1)
+	h.keepDBs(map[int64]struct{}{1: {}}, t1)
+
+	names := func(start time.Time, end time.Time) []string {
+		var names []string
+		for _, tbl := range h.list(start, end) {
+			names = append(names, tbl.String())
+		}
+		return names
+	}
+	// the first versions are valid before the first load
+	if got := names(t0.Add(-time.Hour), t0.Add(-time.Hour)); !reflect.DeepEqual(got, []string{"db.a", "db.b", "db2.c"}) {
+		t.Fatalf("unexpected tables %v", got)
+	}
+	if got := names(t1, t1); !reflect.DeepEqual(got, []string{"db.a2"}) {
+		t.Fatalf("unexpected tables %v", got)
+	}
+	// the latest version in the window
+	if got := names(t0, t1); !reflect.DeepEqual(got, []string{"db.a2", "db.b", "db2.c"}) {
+		t.Fatalf("unexpected tables %v", got)
+	}
+	if tbl, ok := h.at(1, t0, t0); !ok || tbl.Name != "a" {
+		t.Fatalf("unexpected table %v", tbl)
+	}
+
+	// the dropped versions are removed after the retention
+	t2 := t1.Add(2 * time.Hour)
+	h.keepDBs(map[int64]struct{}{1: {}}, t2)
+	if got := names(time.Time{}, t2); !reflect.DeepEqual(got, []string{"db.a2"}) {
+		t.Fatalf("unexpected tables %v", got)
+	}
+	if len(h.versions[1]) != 1 {
+		t.Fatalf("unexpected versions %v", h.versions[1])
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vizColors are the colors of the row categories.
+var vizColors = []string{
+	"#393b79", "#aec7e8", "#ff7f0e", "#ffbb78", "#98df8a", "#bcbd22", "#404040",
+	"#ff9896", "#c5b0d5", "#8c564b", "#1f77b4", "#5254a3", "#FFDB58", "#c49c94",
+	"#e377c2", "#7f7f7f", "#2ca02c", "#9467bd", "#dbdb8d", "#17becf", "#637939",
+	"#6b6ecf", "#9c9ede", "#d62728", "#8ca252", "#8c6d31", "#bd9e39", "#e7cb94",
+	"#843c39", "#ad494a", "#d6616b", "#7b4173", "#a55194", "#ce6dbd", "#de9ed6",
+}
+
+type vizColNode struct {
+	Name     string `json:"name"`
+	ColIndex int    `json:"col_index"`
+	Clust    int    `json:"clust"`
+	Ini      int    `json:"ini"`
+	Rank     int    `json:"rank"`
+	RankVar  int    `json:"rankvar"`
+}
+
+// vizRowNode is a bucket, with the db, the table and the index as the
+// categories, and the key range for the tooltips. The buckets of the whole
+// key space have the tables and indices they cover as the table.
+type vizRowNode struct {
+	Name  string `json:"name"`
+	Cat0  string `json:"cat-0"`
+	Cat1  string `json:"cat-1"`
+	Cat2  string `json:"cat-2"`
+	Clust int    `json:"clust"`
+	Ini   int    `json:"ini"`
+	Start Key    `json:"start"`
+	End   Key    `json:"end"`
+}
+
+type vizCatColors struct {
+	Col map[string]map[string]string `json:"col"`
+	Row map[string]map[string]string `json:"row"`
+}
+
+// viz is the network JSON of clustergrammer, made of the buckets of all the
+// heatmaps without clustering.
+type viz struct {
+	CatColors vizCatColors  `json:"cat_colors"`
+	ColNodes  []vizColNode  `json:"col_nodes"`
+	Links     []interface{} `json:"links"`
+	Mat       [][]uint64    `json:"mat"`
+	RowNodes  []vizRowNode  `json:"row_nodes"`
+	Views     []interface{} `json:"views"`
+}
+
+// buildViz builds the clustergrammer network of the heatmaps, a row for
+// every bucket and a column for every interval. The gap columns are named
+// with a "(gap)" suffix and left empty.
+func buildViz(out outStat) viz {
+	v := viz{
+		CatColors: vizCatColors{Col: map[string]map[string]string{}, Row: map[string]map[string]string{}},
+		ColNodes:  make([]vizColNode, len(out.Times)),
+		Links:     []interface{}{},
+		Mat:       [][]uint64{},
+		RowNodes:  []vizRowNode{},
+		Views:     []interface{}{},
+	}
+	isGap := make([]bool, len(out.Times))
+	for _, i := range out.Gaps {
+		isGap[i] = true
+	}
+	for i, t := range out.Times {
+		name := t.Format(time.RFC3339)
+		if isGap[i] {
+			name += " (gap)"
+		}
+		v.ColNodes[i] = vizColNode{
+			Name:     name,
+			ColIndex: i,
+			Clust:    len(out.Times) - i,
+			Ini:      len(out.Times),
+		}
+	}
+
+	for _, h := range out.Heatmaps {
+		index := "Data"
+		if h.Labels[2] != "" {
+			index = "index " + h.Labels[2]
+		}
+		for i, r := range h.Ranges {
+			table := h.Labels[1]
+			if h.RangeLabels != nil {
+				table = strings.Join(h.RangeLabels[i], ", ")
+				if table == "" {
+					table = "none"
+				}
+			}
+			v.RowNodes = append(v.RowNodes, vizRowNode{
+				Name:  "Bucket: bucket-" + strconv.Itoa(len(v.RowNodes)),
+				Cat0:  "DB: " + h.Labels[0],
+				Cat1:  "Table: " + table,
+				Cat2:  "Data Type: " + index,
+				Start: r.StartKey,
+				End:   r.EndKey,
+			})
+			// shift the values by 1 for the log opacity scale, so only the
+			// gaps are empty
+			row := make([]uint64, len(h.Values[i]))
+			for j, value := range h.Values[i] {
+				if !isGap[j] {
+					row[j] = value + 1
+				}
+			}
+			v.Mat = append(v.Mat, row)
+		}
+	}
+
+	for i := range v.RowNodes {
+		v.RowNodes[i].Clust = len(v.RowNodes) - i
+		v.RowNodes[i].Ini = len(v.RowNodes) - i
+	}
+	for c, cat := range []func(n *vizRowNode) string{
+		func(n *vizRowNode) string { return n.Cat0 },
+		func(n *vizRowNode) string { return n.Cat1 },
+		func(n *vizRowNode) string { return n.Cat2 },
+	} {
+		colors := make(map[string]string)
+		for i := range v.RowNodes {
+			name := cat(&v.RowNodes[i])
+			if _, ok := colors[name]; ok {
+				continue
+			}
+			n := len(colors)
+			idx := (n + 1) * (c + 1)
+			if idx >= len(vizColors) {
+				idx = (4 + n) % len(vizColors)
+			}
+			colors[name] = vizColors[idx]
+		}
+		v.CatColors.Row["cat-"+strconv.Itoa(c)] = colors
+	}
+	return v
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestViz(t *testing.T) {
+	old := stat
+	defer func() { stat = old }()
+	s := newRingStatStore(10)
+	stat = s
+
+	oldTables := tables
+	defer func() { tables = oldTables }()
+	tables = newTableHistory()
+	tables.update(1, []*Table{{ID: 1, DB: "test", Name: "t", Handle: "id", Indices: map[int64]string{1: "idx"}}}, time.Now())
+
+	now := time.Now().Truncate(time.Second)
+	for i, v := range []uint64{10, 20} {
+		s.append(&Stat{
+			Time: now.Add(time.Duration(i-2) * time.Minute),
+			Regions: []*regionInfo{
+				newRegionInfo("", GenTableRecordPrefix(1), 1),
+				newRegionInfo(GenTableRecordPrefix(1), GenTableRecordPrefix(2), v),
+				newRegionInfo(GenTableRecordPrefix(2), "", 1),
+			},
+		})
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/heatmaps?start=-150s&format=viz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected response %d %s", w.Code, w.Body)
+	}
+	var v viz
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.ColNodes) != 2 || v.ColNodes[0].Clust != 2 || v.ColNodes[1].ColIndex != 1 {
+		t.Fatalf("unexpected col nodes %v", v.ColNodes)
+	}
+	if len(v.RowNodes) != len(v.Mat) || len(v.RowNodes) < 2 {
+		t.Fatalf("unexpected rows %v %v", v.RowNodes, v.Mat)
+	}
+	first, last := v.RowNodes[0], v.RowNodes[len(v.RowNodes)-1]
+	if first.Name != "Bucket: bucket-0" || first.Cat0 != "DB: test" || first.Cat1 != "Table: t" || first.Clust != len(v.RowNodes) {
+		t.Fatalf("unexpected row node %v", first)
+	}
+	if first.Cat2 != "Data Type: Data" || last.Cat2 != "Data Type: index idx" {
+		t.Fatalf("unexpected categories %v %v", first, last)
+	}
+	// the values are shifted by 1
+	if row := v.Mat[0]; row[0] != 11 || row[1] != 21 {
+		t.Fatalf("unexpected values %v", row)
+	}
+	colors := v.CatColors.Row["cat-2"]
+	if len(colors) != 2 || colors["Data Type: Data"] == colors["Data Type: index idx"] {
+		t.Fatalf("unexpected colors %v", v.CatColors.Row)
+	}
+	if v.Links == nil || v.Views == nil {
+		t.Fatalf("links and views must be empty arrays")
+	}
+}
+
+func TestVizClusterGaps(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	out := outStat{
+		Times: []time.Time{now.Add(-2 * time.Minute), now.Add(-time.Minute)},
+		Gaps:  []int{1},
+		Heatmaps: []Heatmap{{
+			Labels:      []string{"cluster", "", ""},
+			Ranges:      []Range{{}, {}},
+			Values:      [][]uint64{{10, 0}, {20, 0}},
+			RangeLabels: [][]string{nil, {"test.t", "test.t.idx"}},
+		}},
+	}
+	v := buildViz(out)
+	if v.ColNodes[0].Name != now.Add(-2*time.Minute).Format(time.RFC3339) || v.ColNodes[1].Name != now.Add(-time.Minute).Format(time.RFC3339)+" (gap)" {
+		t.Fatalf("unexpected col nodes %v", v.ColNodes)
+	}
+	if v.RowNodes[0].Cat1 != "Table: none" || v.RowNodes[1].Cat1 != "Table: test.t, test.t.idx" {
+		t.Fatalf("unexpected row nodes %v", v.RowNodes)
+	}
+	expected := [][]uint64{{11, 0}, {21, 0}}
+	if !reflect.DeepEqual(v.Mat, expected) {
+		t.Fatalf("want %v, but got %v", expected, v.Mat)
+	}
+}